@@ -3,39 +3,74 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
 	"github.com/redis/go-redis/v9"
 	httpSwagger "github.com/swaggo/http-swagger"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
 // APIServer represents the API server.
 type APIServer struct {
-	listenAddr  string        // Address to listen on
-	dbStore     *PostgresDB   // Database store
-	redisClient *redis.Client // Redis client
+	listenAddr   string            // Address to listen on
+	server       ServerConfig      // HTTP timeouts
+	auth         AuthConfig        // Token lifetimes and signing keys
+	maxBodyBytes int64             // Largest accepted request body
+	validator    *requestValidator // Request body validation
+	dbStore      Storage           // Database store
+	redisClient  *redis.Client     // Redis client
+	mailer       Mailer            // Outgoing e-mail
+	publicURL    string            // Base URL used in mailed links
+	trustProxy   bool              // Take client IPs from X-Forwarded-For
+	rateLimits   RateLimitConfig   // Request limits per route
+	limiter      rateLimiter       // Counts requests against rateLimits
+	metrics      MetricsConfig     // Prometheus endpoint settings
+	background   sync.WaitGroup    // Tasks still running after their request, such as mail
 }
 
 // apiFunc is a function type for handling API requests.
 type apiFunc func(w http.ResponseWriter, r *http.Request) error
 
-// ApiError represents an API error response.
-type ApiError struct {
-	Error string `json:"error"`
-}
-
 // makeHTTPHandleFunc creates an HTTP handler function from an apiFunc.
+// Returned errors are sent as problem+json responses by writeError.
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(writer http.ResponseWriter, request *http.Request) {
 		if err := f(writer, request); err != nil {
-			writeJSON(writer, http.StatusBadRequest, ApiError{Error: err.Error()})
+			writeError(writer, request, err)
 		}
 	}
 }
 
+// decodeJSON decodes the JSON request body into v and validates it.
+// Bodies larger than maxBodyBytes, unknown fields and trailing data are rejected.
+func (s *APIServer) decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return invalid("request body must not exceed %d bytes", tooLarge.Limit)
+		}
+		return invalid("invalid JSON body: %v", err)
+	}
+	if decoder.More() {
+		return invalid("invalid JSON body: unexpected data after the JSON value")
+	}
+	return s.validator.Struct(v)
+}
+
 // writeJSON writes JSON data to the response writer.
 func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
 	w.Header().Add("Content-Type", "application/json")
@@ -43,37 +78,176 @@ func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
-// Run starts the API server.
+// Run starts the API server and serves until SIGINT or SIGTERM, then shuts it down as serve describes.
 func (s *APIServer) Run() error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// After the first signal a second one kills the process instead of waiting for the drain
+	context.AfterFunc(ctx, stop)
+	return s.serve(ctx)
+}
+
+// serve serves until ctx is done. It then stops accepting connections, gives in-flight requests and
+// background tasks the shutdown timeout to finish and closes the database and Redis clients.
+func (s *APIServer) serve(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           s.Router(),
+		ReadTimeout:       s.server.ReadTimeout,
+		ReadHeaderTimeout: s.server.ReadHeaderTimeout,
+		WriteTimeout:      s.server.WriteTimeout,
+		IdleTimeout:       s.server.IdleTimeout,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		log.Printf("Server running on port %v", s.listenAddr)
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		s.close()
+		return fmt.Errorf("starting server run into problems: %w", err)
+	case <-ctx.Done():
+	}
+	log.Printf("Shutting down, waiting up to %s for requests to finish", s.server.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.server.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		err = fmt.Errorf("draining requests: %w", err)
+	}
+	return errors.Join(err, s.waitBackground(shutdownCtx), s.close())
+}
+
+// backgroundTimeout bounds a task started with goBackground.
+const backgroundTimeout = 30 * time.Second
+
+// goBackground runs f after the response has been sent, so its duration does not show in the response time.
+// The request context's values are kept but not its cancellation. Run waits for these tasks on shutdown.
+func (s *APIServer) goBackground(r *http.Request, f func(ctx context.Context)) {
+	ctx := context.WithoutCancel(r.Context())
+	s.background.Add(1)
+	go func() {
+		defer s.background.Done()
+		ctx, cancel := context.WithTimeout(ctx, backgroundTimeout)
+		defer cancel()
+		f(ctx)
+	}()
+}
+
+// waitBackground waits for the tasks started with goBackground until ctx is done.
+func (s *APIServer) waitBackground(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("waiting for background tasks: %w", ctx.Err())
+	}
+}
+
+// close releases the database and Redis connections.
+func (s *APIServer) close() error {
+	var errs []error
+	if err := s.dbStore.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing database: %w", err))
+	}
+	if err := s.redisClient.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing redis: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+// Router builds the HTTP handler with all API routes registered.
+func (s *APIServer) Router() http.Handler {
 	router := mux.NewRouter()
+	router.NotFoundHandler = makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return notFound("no route for %s", r.URL.Path)
+	})
+	router.MethodNotAllowedHandler = makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return methodNotAllowed(r.Method)
+	})
+	router.Use(s.rateLimit)
 
 	// Swagger endpoint
 	router.PathPrefix("/swagger/").Handler(httpSwagger.Handler(httpSwagger.URL("/docs/swagger.json")))
 	router.HandleFunc("/docs/swagger.json", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "./docs/swagger.json")
 	})
+	if s.metrics.Enabled {
+		router.Handle("/metrics", metricsHandler(s.metrics.Token)).Methods("GET")
+	}
+	router.HandleFunc("/healthz", makeHTTPHandleFunc(s.handleHealthz)).Methods("GET")
+	router.HandleFunc("/readyz", makeHTTPHandleFunc(s.handleReadyz)).Methods("GET")
+	router.HandleFunc("/.well-known/jwks.json", makeHTTPHandleFunc(s.handleJWKS)).Methods("GET")
 	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin))
+	router.HandleFunc("/token/refresh", makeHTTPHandleFunc(s.handleRefreshToken))
+	router.HandleFunc("/verify-email", makeHTTPHandleFunc(s.handleVerifyEmail))
+	router.HandleFunc("/verify-email/resend", makeHTTPHandleFunc(s.handleResendVerification))
+	router.HandleFunc("/password/forgot", makeHTTPHandleFunc(s.handleForgotPassword))
+	router.HandleFunc("/password/reset", makeHTTPHandleFunc(s.handleResetPasswordForm)).Methods("GET")
+	router.HandleFunc("/password/reset", makeHTTPHandleFunc(s.handleResetPassword))
+	router.HandleFunc("/logout", isAuthenticated(makeHTTPHandleFunc(s.handleLogout), s)).Methods("POST")
 	router.HandleFunc("/{id}/logout", isAuthenticated(makeHTTPHandleFunc(s.handleLogout), s))
+	router.HandleFunc("/me", isAuthenticated(makeHTTPHandleFunc(s.handleMe), s)).Methods("GET")
+	router.HandleFunc("/lockouts", requirePermission(permManageAccount, makeHTTPHandleFunc(s.handleClearLockout), s)).Methods("DELETE")
+	router.HandleFunc("/lockouts/events", requireRole("admin", makeHTTPHandleFunc(s.handleListLockoutEvents), s)).Methods("GET")
+	router.HandleFunc("/account", requirePermission(permListAccounts, makeHTTPHandleFunc(s.handleGetAllAccount), s)).Methods("GET")
 	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleAccount))
 	router.HandleFunc("/account/{id}", isAuthenticated(makeHTTPHandleFunc(s.handleGetAccountByID), s))
-
-	log.Printf("Server running on port %v", s.listenAddr)
-	err := http.ListenAndServe(s.listenAddr, router)
-	if err != nil {
-		return fmt.Errorf("starting server run into problems")
+	router.HandleFunc("/account/{id}/password", isAuthenticated(makeHTTPHandleFunc(s.handleChangePassword), s))
+	router.HandleFunc("/account/{id}/tokens", requirePermission(permManageAccount, makeHTTPHandleFunc(s.handleRevokeAccountTokens), s)).Methods("DELETE")
+	router.HandleFunc("/posts", requirePermission(permWritePost, makeHTTPHandleFunc(s.handleCreatePost), s)).Methods("POST")
+	router.HandleFunc("/posts", makeHTTPHandleFunc(s.handleListPosts)).Methods("GET")
+	router.HandleFunc("/posts/{id}", makeHTTPHandleFunc(s.handleGetPost)).Methods("GET")
+	router.HandleFunc("/posts/{id}", requirePermission(permWritePost, makeHTTPHandleFunc(s.handlePostByID), s))
+	router.HandleFunc("/search", makeHTTPHandleFunc(s.handleSearchPosts)).Methods("GET")
+	router.HandleFunc("/tags", makeHTTPHandleFunc(s.handleListTags)).Methods("GET")
+	router.HandleFunc("/categories", makeHTTPHandleFunc(s.handleListCategories)).Methods("GET")
+	router.HandleFunc("/categories", requirePermission(permManageTerms, makeHTTPHandleFunc(s.handleCreateCategory), s)).Methods("POST")
+	if !s.metrics.Enabled {
+		return withRequestID(deprecateTokenHeader(router))
 	}
-	return nil
+	return withRequestID(deprecateTokenHeader(instrument(router)))
 }
 
 // newAPIServer creates a new APIServer instance.
-func newAPIServer(listenAddr string, store *PostgresDB, redisClient *redis.Client) *APIServer {
+func newAPIServer(cfg *Config, store Storage, redisClient *redis.Client, mailer Mailer) *APIServer {
 	return &APIServer{
-		listenAddr:  listenAddr,
-		dbStore:     store,
-		redisClient: redisClient,
+		listenAddr:   cfg.ListenAddr,
+		server:       cfg.Server,
+		publicURL:    strings.TrimSuffix(cfg.PublicURL, "/"),
+		trustProxy:   cfg.TrustProxyHeaders,
+		rateLimits:   cfg.RateLimit,
+		limiter:      newRateLimiter(redisClient),
+		metrics:      cfg.Metrics,
+		auth:         cfg.Auth,
+		maxBodyBytes: cfg.Validation.MaxBodyBytes,
+		validator:    &requestValidator{passwordPolicy: cfg.Validation.Password},
+		dbStore:      store,
+		redisClient:  redisClient,
+		mailer:       mailer,
 	}
 }
 
+// handleJWKS serves the public keys access tokens are signed with.
+// @Summary Token signing keys
+// @Description Public keys in JWK format for verifying access tokens. Empty when tokens are signed with HS256.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} JWKS
+// @Router /.well-known/jwks.json [get]
+func (s *APIServer) handleJWKS(w http.ResponseWriter, r *http.Request) error {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	return writeJSON(w, http.StatusOK, s.auth.keys.jwks())
+}
+
 // handleLogin handles the login request.
 // Login endpoint
 // @Summary Log in with username and password
@@ -83,79 +257,217 @@ func newAPIServer(listenAddr string, store *PostgresDB, redisClient *redis.Clien
 // username body string true "UserName"
 // @Param request body LoginRequest true "Login details"
 // @Success 200 {object} LoginResponse
-// @Failure 400 {object} ApiError
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem "E-mail address not verified"
+// @Failure 429 {object} Problem "Too many failed logins; see Retry-After"
 // @Router /login [post]
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
-		return fmt.Errorf("method not allowed %s", r.Method)
+		return methodNotAllowed(r.Method)
 	}
 	var req LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	ip := clientIP(r, s.trustProxy)
+	wait, err := loginLockedFor(r.Context(), s.redisClient, req.UserName, ip)
+	if err != nil {
 		return err
 	}
+	if wait > 0 {
+		authLoginFailures.WithLabelValues("locked").Inc()
+		return tooManyRequests(wait, "too many failed logins, try again later")
+	}
 	account, err := s.dbStore.GetAccountByUsername(req.UserName)
+	var domainErr *DomainError
+	if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+		return s.loginFailed(r, req.UserName, ip)
+	}
 	if err != nil {
 		return err
 	}
 	if !account.ValidPassword(req.Password) {
-		permissionDenied(w, "permission denied")
-		return nil
+		return s.loginFailed(r, req.UserName, ip)
+	}
+	if err := recordLoginSuccess(r.Context(), s.redisClient, s.auth.Lockout, req.UserName); err != nil {
+		return err
 	}
-	token, err := generateJWT(account)
+	if !account.EmailVerified {
+		authLoginFailures.WithLabelValues("unverified").Inc()
+		return forbidden("e-mail address has not been verified")
+	}
+	token, err := generateJWT(account, s.auth)
 	if err != nil {
 		return err
 	}
+	refreshToken, err := issueRefreshToken(r.Context(), s.redisClient, s.auth.RefreshTokenTTL, account.ID, "")
+	if err != nil {
+		return err
+	}
+	authLogins.Inc()
+	return s.writeTokens(w, account, token, refreshToken)
+}
+
+// writeTokens sends a freshly issued token pair. In cookie mode the access token goes into an HttpOnly cookie
+// instead of the body, and the body carries the CSRF token to echo in the X-CSRF-Token header.
+func (s *APIServer) writeTokens(w http.ResponseWriter, account *Account, token, refreshToken string) error {
 	resp := &LoginResponse{
-		Token:    token,
-		UserName: account.Username,
+		Token:        token,
+		RefreshToken: refreshToken,
+		UserName:     account.Username,
+	}
+	if s.auth.Cookie.Enabled {
+		resp.CSRFToken = setAuthCookies(w, s.auth, token)
+		resp.Token = ""
 	}
 	return writeJSON(w, http.StatusOK, resp)
 }
 
+// loginFailed counts a failed login and returns the error to answer it with.
+// Unknown usernames count like wrong passwords, so lockouts do not reveal which accounts exist.
+func (s *APIServer) loginFailed(r *http.Request, username, ip string) error {
+	wait, err := recordLoginFailure(r.Context(), s.redisClient, s.auth.Lockout, username, ip)
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		authLoginFailures.WithLabelValues("locked").Inc()
+		return tooManyRequests(wait, "too many failed logins, try again later")
+	}
+	authLoginFailures.WithLabelValues("invalid_credentials").Inc()
+	return unauthorized("invalid username or password")
+}
+
+// handleRefreshToken handles the token refresh request.
+// Refresh endpoint
+// @Summary Exchange a refresh token for a new access token
+// @Description Rotates the refresh token. Reusing an already rotated token revokes the whole token family.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} Problem
+// @Router /token/refresh [post]
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	var req RefreshRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	record, refreshToken, err := rotateRefreshToken(r.Context(), s.redisClient, s.auth.RefreshTokenTTL, req.RefreshToken)
+	if err != nil {
+		return err
+	}
+	account, err := s.dbStore.GetAccountByID(record.AccountID)
+	if err != nil {
+		return err
+	}
+	token, err := generateJWT(account, s.auth)
+	if err != nil {
+		return err
+	}
+	return s.writeTokens(w, account, token, refreshToken)
+}
+
 // handleLogout handles the logout request.
 // Logout endpoint
 // @Summary Log out
+// @Description Revokes the access token of the request. /{id}/logout is kept for older clients that send the token
+// @Description header; the ID is ignored, and it does not end cookie sessions.
 // @Tags auth
 // @Produce plain
-// @Param id path int true "Account ID"
-// @Param token header string true "Auth token"
+// @Security BearerAuth
+// @Param refresh-token header string false "Refresh token to revoke"
 // @Success 200 {string} string
+// @Router /logout [post]
 // @Router /{id}/logout [get]
 func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
-	// Get token from cookie
-	token := r.Header.Get("token")
+	raw, fromCookie := tokenFromRequest(r, s.auth)
+	// Browsers send cookies along with cross-site GETs, so cookie sessions only end through a POST with the CSRF token
+	if fromCookie && r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	token, err := validateToken(raw, s.auth)
+	if err != nil {
+		return err
+	}
 
-	// Blacklist token in Redis
-	s.redisClient.Set(context.Background(), token, "", 1*time.Minute)
+	// Revoke the access token until it expires
+	if err := revokeToken(r.Context(), s.redisClient, token.Claims.(jwt.MapClaims)); err != nil {
+		return err
+	}
 
-	// Clear token cookie
-	r.Header.Del("token")
+	// Revoke the refresh token family, if the client sent one
+	if refreshToken := r.Header.Get("refresh-token"); refreshToken != "" {
+		if err := revokeRefreshToken(r.Context(), s.redisClient, refreshToken); err != nil {
+			return err
+		}
+	}
 
-	w.WriteHeader(http.StatusOK)
+	if s.auth.Cookie.Enabled {
+		clearAuthCookies(w, s.auth)
+	}
+	authLogouts.Inc()
 	return writeJSON(w, http.StatusOK, "Logout successful")
 }
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAllAccount(w, r)
+
+// handleMe handles the request for the caller's own account.
+// @Summary Current account
+// @Description Returns the account the access token was issued to, with its role and permissions.
+// @Tags accounts
+// @Produce json
+// @Security BearerAuth
+// @Success 200 {object} MeResponse
+// @Failure 401 {object} Problem
+// @Router /me [get]
+func (s *APIServer) handleMe(w http.ResponseWriter, r *http.Request) error {
+	caller, ok := principalFromContext(r.Context())
+	if !ok {
+		return unauthorized("missing access token")
+	}
+	role, err := s.dbStore.GetRole(caller.RoleID)
+	if err != nil {
+		return err
 	}
+	return writeJSON(w, http.StatusOK, &MeResponse{Account: caller, Role: role.Name, Permissions: role.Permissions})
+}
+
+func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "POST" {
 		return s.handleCreateAccount(w, r)
 	}
-	return fmt.Errorf("%v Method not Allow", r.Method)
+	return methodNotAllowed(r.Method)
 }
 
-// handleGetAllAccount handles the request to get all accounts.
-// @Summary Get all accounts.
-// @Description Retrieves a list of all accounts.
+// handleGetAllAccount handles the request to list accounts one page at a time.
+// @Summary List accounts.
+// @Description Retrieves a page of accounts. Requires the account:list permission.
+// @Description Pass the returned nextCursor as cursor to fetch the following page.
 // @Produce json
-// @Success 200 {array} Account
+// @Security BearerAuth
+// @Param limit query int false "Page size (default 50, max 200)"
+// @Param cursor query string false "Cursor of the page to fetch"
+// @Param sort query string false "id, createdAt, username or country; prefix with - for descending"
+// @Param country query string false "Only accounts from this country"
+// @Param role query int false "Only accounts with this role ID"
+// @Param createdAfter query string false "Only accounts created after this RFC 3339 time"
+// @Success 200 {object} AccountPage
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
 // @Router /account [get]
 func (s *APIServer) handleGetAllAccount(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.dbStore.GetAllAccounts()
+	query, err := parseAccountQuery(r.URL.Query())
 	if err != nil {
 		return err
 	}
-	err = writeJSON(w, http.StatusOK, accounts)
+	page, err := s.dbStore.ListAccounts(query)
+	if err != nil {
+		return err
+	}
+	err = writeJSON(w, http.StatusOK, page)
 	if err != nil {
 		return err
 	}
@@ -167,17 +479,22 @@ func (s *APIServer) handleGetAllAccount(w http.ResponseWriter, r *http.Request)
 // @Tags accounts
 // @Produce json
 // @Param id path int true "Account ID"
-// @Param token header string true "Auth token"
+// @Security BearerAuth
 // @Success 200 {object} Account
-// @Failure 404 {object} ApiError
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
 // @Router /account/{id} [get]
 func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		id, err := getID(r)
-		if err != nil {
-			return err
-		}
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	// Only the owner and callers that may manage accounts get past this point
+	if err := authorizeAccount(r, s, id); err != nil {
+		return err
+	}
 
+	if r.Method == "GET" {
 		account, err := s.dbStore.GetAccountByID(id)
 		if err != nil {
 			return err
@@ -189,25 +506,45 @@ func (s *APIServer) handleGetAccountByID(w http.ResponseWriter, r *http.Request)
 		return s.handleDeleteAccount(w, r)
 	}
 
-	return fmt.Errorf("method not allowed %s", r.Method)
+	if r.Method == "PATCH" || r.Method == "PUT" {
+		return s.handleUpdateAccount(w, r)
+	}
+
+	return methodNotAllowed(r.Method)
 }
 
 // handleCreateAccount handles the request to create an account.
 // @Summary Create a new account.
 // @Description Creates a new account based on the provided request data.
+// @Description Choosing a roleId requires a token with the account:assign-role permission.
+// @Description A verification link is mailed to the new address; logging in requires a verified address.
 // @Accept json
 // @Produce json
+// @Security BearerAuth
 // @Param request body AccountRequest true "Account details to create"
 // @Success 200 {object} Account
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
+// @Failure 409 {object} Problem "Username or e-mail already in use"
 // @Router /account [post]
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	var accountReq *AccountRequest
-	err := json.NewDecoder(r.Body).Decode(&accountReq)
+	var accountReq AccountRequest
+	err := s.decodeJSON(w, r, &accountReq)
 	if err != nil {
 		return err
 	}
 	if accountReq.RoleId == 0 {
-		accountReq.RoleId = 2
+		accountReq.RoleId = roleUser
+	}
+	if accountReq.RoleId != roleUser && !callerHasPermission(r, s, permAssignRole) {
+		return forbidden("not allowed to choose a role")
+	}
+	if _, err := s.dbStore.GetRole(accountReq.RoleId); err != nil {
+		var domainErr *DomainError
+		if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+			return invalidField("roleId", "unknown role %d", accountReq.RoleId)
+		}
+		return err
 	}
 	account, err := NewAccount(
 		accountReq.FirstName,
@@ -224,6 +561,7 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 	if err != nil {
 		return err
 	}
+	s.sendVerificationEmail(r.Context(), account)
 	return writeJSON(w, http.StatusOK, account)
 }
 
@@ -232,7 +570,7 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 // @Tags accounts
 // @Accept json
 // @Produce json
-// @Param token header string true "Auth token"
+// @Security BearerAuth
 // @Param id path int true "Account ID"
 // @Success 200 {object} map[string]int "deleted":int "Success"
 // @Router /account/{id} [delete]
@@ -246,3 +584,621 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 	}
 	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
 }
+
+// handleUpdateAccount handles the request to update an account.
+// @Summary Update an account by ID
+// @Description Updates the given fields of an account. Only the owner or an admin may update it.
+// @Description Changing the e-mail address marks it unverified and mails a new verification link.
+// @Description A new password revokes every token of the account, including the one sent with this request.
+// @Tags accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Account ID"
+// @Param request body UpdateAccountRequest true "Fields to update"
+// @Success 200 {object} Account
+// @Failure 400 {object} Problem
+// @Failure 409 {object} Problem "E-mail already in use"
+// @Router /account/{id} [patch]
+// @Router /account/{id} [put]
+func (s *APIServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	var req UpdateAccountRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	// A new password is hashed like in NewAccount but stored on its own, together with a token version bump
+	var hash string
+	if req.Password != nil {
+		if hash, err = hashPassword(*req.Password); err != nil {
+			return err
+		}
+	}
+	account, err := s.dbStore.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+	wasVerified := account.EmailVerified
+	req.Apply(account)
+	if err := s.dbStore.UpdateAccount(account); err != nil {
+		return err
+	}
+	if hash != "" {
+		if account.TokenVersion, err = s.setPassword(r.Context(), account.ID, hash); err != nil {
+			return err
+		}
+	}
+	if wasVerified && !account.EmailVerified {
+		s.sendVerificationEmail(r.Context(), account)
+	}
+	return writeJSON(w, http.StatusOK, account)
+}
+
+// handleVerifyEmail handles the link mailed to verify an e-mail address.
+// @Summary Verify an e-mail address
+// @Description Marks the account's e-mail address verified. Each link works once and only for the address it was sent to.
+// @Tags auth
+// @Produce json
+// @Param token query string true "Verification token from the mailed link"
+// @Success 200 {object} Account
+// @Failure 400 {object} Problem
+// @Router /verify-email [get]
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+	claims, err := parseEmailToken(s.auth.JWTSecret, r.URL.Query().Get("token"))
+	if err != nil {
+		return err
+	}
+	account, err := s.dbStore.GetAccountByID(claims.AccountID)
+	var domainErr *DomainError
+	if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+		return invalidField("token", "invalid verification token")
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(account.Email, claims.Email) {
+		return invalidField("token", "the e-mail address has changed since this link was sent")
+	}
+	if account.EmailVerified {
+		return writeJSON(w, http.StatusOK, account)
+	}
+	if err := consumeEmailToken(r.Context(), s.redisClient, claims); err != nil {
+		return err
+	}
+	account.EmailVerified = true
+	if err := s.dbStore.UpdateAccount(account); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, account)
+}
+
+// handleResendVerification handles the request to mail a new verification link.
+// @Summary Resend the verification e-mail
+// @Description Always answers 202 so the response does not reveal whether the address is registered.
+// @Tags auth
+// @Accept json
+// @Param request body ResendVerificationRequest true "Address to verify"
+// @Success 202
+// @Failure 400 {object} Problem
+// @Router /verify-email/resend [post]
+func (s *APIServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	var req ResendVerificationRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	account, err := s.dbStore.GetAccountByEmail(req.Email)
+	var domainErr *DomainError
+	if err != nil && !(errors.As(err, &domainErr) && domainErr.Kind == KindNotFound) {
+		return err
+	}
+	if err == nil && !account.EmailVerified {
+		// Sent in the background so the response takes as long whether or not the address is registered
+		s.goBackground(r, func(ctx context.Context) {
+			s.sendVerificationEmail(ctx, account)
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// handleForgotPassword handles the request to mail a password reset link.
+// @Summary Request a password reset
+// @Description Mails a single-use reset link to the address if it belongs to an account.
+// @Description Always answers 202 so the response does not reveal whether the address is registered.
+// @Tags auth
+// @Accept json
+// @Param request body ForgotPasswordRequest true "Address of the account"
+// @Success 202
+// @Failure 400 {object} Problem
+// @Router /password/forgot [post]
+func (s *APIServer) handleForgotPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	var req ForgotPasswordRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	account, err := s.dbStore.GetAccountByEmail(req.Email)
+	var domainErr *DomainError
+	if err != nil && !(errors.As(err, &domainErr) && domainErr.Kind == KindNotFound) {
+		return err
+	}
+	if err == nil {
+		// Sent in the background so the response takes as long whether or not the address is registered
+		s.goBackground(r, func(ctx context.Context) {
+			s.sendPasswordResetEmail(ctx, account)
+		})
+	}
+	w.WriteHeader(http.StatusAccepted)
+	return nil
+}
+
+// handleResetPasswordForm serves the page the mailed reset link opens.
+// @Summary Password reset page
+// @Description HTML form for the mailed reset link. It posts the token and the new password back to /password/reset.
+// @Tags auth
+// @Produce html
+// @Param token query string true "Reset token from the mailed link"
+// @Success 200 {string} string
+// @Router /password/reset [get]
+func (s *APIServer) handleResetPasswordForm(w http.ResponseWriter, r *http.Request) error {
+	return renderResetPasswordPage(w, http.StatusOK, resetPasswordView{Token: r.URL.Query().Get("token")})
+}
+
+// handleResetPassword handles the request to set a new password with a mailed reset token.
+// @Summary Reset a forgotten password
+// @Description Consumes the reset token, sets the new password and revokes all access and refresh tokens of the account.
+// @Description A form post from the reset page is answered with the page instead of a status.
+// @Tags auth
+// @Accept json,x-www-form-urlencoded
+// @Param request body ResetPasswordRequest true "Reset token and new password"
+// @Success 204
+// @Failure 400 {object} Problem
+// @Router /password/reset [post]
+func (s *APIServer) handleResetPassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	var req ResetPasswordRequest
+	if isFormPost(r) {
+		err := s.decodeResetPasswordForm(w, r, &req)
+		if err == nil {
+			err = s.resetPassword(r.Context(), &req)
+		}
+		return resetPasswordFormResult(w, req.Token, err)
+	}
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if err := s.resetPassword(r.Context(), &req); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleChangePassword handles the request to change the caller's own password.
+// @Summary Change password
+// @Description Changes the password after checking the current one. Every token issued before the change stops working,
+// @Description so the response carries a fresh token pair for the calling client.
+// @Tags accounts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Account ID"
+// @Param request body ChangePasswordRequest true "Current and new password"
+// @Success 200 {object} LoginResponse
+// @Failure 400 {object} Problem
+// @Failure 401 {object} Problem
+// @Failure 403 {object} Problem
+// @Router /account/{id}/password [post]
+func (s *APIServer) handleChangePassword(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return err
+	}
+	if caller.ID != id {
+		return forbidden("only the account owner can change its password")
+	}
+	var req ChangePasswordRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	// The caller may come from the account cache, which keeps no password hash, so read it past the cache
+	account, err := s.dbStore.GetAccountByUsername(caller.Username)
+	if err != nil {
+		return err
+	}
+	if !account.ValidPassword(req.CurrentPassword) {
+		return invalidField("currentPassword", "does not match")
+	}
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		return err
+	}
+	if account.TokenVersion, err = s.setPassword(r.Context(), account.ID, hash); err != nil {
+		return err
+	}
+	token, err := generateJWT(account, s.auth)
+	if err != nil {
+		return err
+	}
+	refreshToken, err := issueRefreshToken(r.Context(), s.redisClient, s.auth.RefreshTokenTTL, account.ID, "")
+	if err != nil {
+		return err
+	}
+	return s.writeTokens(w, account, token, refreshToken)
+}
+
+// handleRevokeAccountTokens handles the request to revoke every token of an account.
+// @Summary Revoke all tokens of an account
+// @Description Invalidates every access and refresh token issued to the account so far. Requires the account:manage permission.
+// @Tags accounts
+// @Security BearerAuth
+// @Param id path int true "Account ID"
+// @Success 204
+// @Failure 403 {object} Problem
+// @Failure 404 {object} Problem
+// @Router /account/{id}/tokens [delete]
+func (s *APIServer) handleRevokeAccountTokens(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	if _, err := s.revokeAccountTokens(r.Context(), id); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleClearLockout handles the request to lift a login lockout.
+// @Summary Clear a login lockout
+// @Description Removes the lock and failure count of a username, a client IP or both. Requires the account:manage permission.
+// @Tags auth
+// @Security BearerAuth
+// @Param username query string false "Locked username"
+// @Param ip query string false "Locked client IP"
+// @Success 204
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
+// @Router /lockouts [delete]
+func (s *APIServer) handleClearLockout(w http.ResponseWriter, r *http.Request) error {
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return err
+	}
+	username, ip := r.URL.Query().Get("username"), r.URL.Query().Get("ip")
+	if username == "" && ip == "" {
+		return invalid("username or ip is required")
+	}
+	var subjects []string
+	if username != "" {
+		subjects = append(subjects, lockoutSubjects(username, "")[0])
+	}
+	if ip != "" {
+		if net.ParseIP(ip) == nil {
+			return invalidField("ip", "not an IP address")
+		}
+		subjects = append(subjects, lockoutSubjects("", ip)[1])
+	}
+	for _, subject := range subjects {
+		if err := clearLockout(r.Context(), s.redisClient, subject, caller.Username); err != nil {
+			return err
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// handleListLockoutEvents handles the request to list recent lockout and unlock events.
+// @Summary List lockout events
+// @Description Lists the most recent login lockout and unlock events, newest first. Requires the admin role.
+// @Tags auth
+// @Produce json
+// @Security BearerAuth
+// @Param limit query int false "Number of events (default 100, max 1000)"
+// @Success 200 {array} LockoutEvent
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
+// @Router /lockouts/events [get]
+func (s *APIServer) handleListLockoutEvents(w http.ResponseWriter, r *http.Request) error {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 1000 {
+			return invalidField("limit", "must be between 1 and 1000")
+		}
+		limit = n
+	}
+	events, err := listLockoutEvents(r.Context(), s.redisClient, int64(limit))
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, events)
+}
+
+// handleListPosts handles the request to list published posts.
+// @Summary List published posts
+// @Description Lists published posts, optionally filtered by tag, category (including subcategories) or author username.
+// @Tags posts
+// @Produce json
+// @Param tag query string false "Tag name"
+// @Param category query string false "Category slug"
+// @Param author query string false "Author username"
+// @Success 200 {array} Post
+// @Router /posts [get]
+func (s *APIServer) handleListPosts(w http.ResponseWriter, r *http.Request) error {
+	query := PostQuery{
+		Status:   postPublished,
+		Category: r.URL.Query().Get("category"),
+	}
+	// Tags are stored normalized, so "Go Lang" finds posts tagged go-lang
+	if tag := r.URL.Query().Get("tag"); tag != "" {
+		query.Tag = slugify(tag)
+		if query.Tag == "" {
+			return writeJSON(w, http.StatusOK, []*Post{})
+		}
+	}
+	if username := r.URL.Query().Get("author"); username != "" {
+		author, err := s.dbStore.GetAccountByUsername(username)
+		var domainErr *DomainError
+		if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+			// An unknown author has no posts
+			return writeJSON(w, http.StatusOK, []*Post{})
+		}
+		if err != nil {
+			return err
+		}
+		query.AuthorID = author.ID
+	}
+	posts, err := s.dbStore.ListPosts(query)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, posts)
+}
+
+// handleCreatePost handles the request to create a post.
+// @Summary Create a post
+// @Description Creates a post authored by the caller. Status defaults to draft.
+// @Tags posts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body PostRequest true "Post to create"
+// @Success 200 {object} Post
+// @Failure 400 {object} Problem
+// @Router /posts [post]
+func (s *APIServer) handleCreatePost(w http.ResponseWriter, r *http.Request) error {
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return err
+	}
+	var req PostRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	post, err := NewPost(caller.ID, &req)
+	if err != nil {
+		return err
+	}
+	if err := s.dbStore.CreatePost(post); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, post)
+}
+
+// handleGetPost handles the request to get a post by ID.
+// Drafts are only visible to their author and to callers allowed to manage posts.
+// @Summary Get post by ID
+// @Tags posts
+// @Produce json
+// @Param id path int true "Post ID"
+// @Security BearerAuth
+// @Success 200 {object} Post
+// @Failure 404 {object} Problem
+// @Router /posts/{id} [get]
+func (s *APIServer) handleGetPost(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	post, err := s.dbStore.GetPostByID(id)
+	if err != nil {
+		return err
+	}
+	if post.Status != postPublished && !s.canEditPost(r, post) {
+		return notFound("post %d not found", id)
+	}
+	return writeJSON(w, http.StatusOK, post)
+}
+
+// handlePostByID dispatches updates and deletes of a single post.
+func (s *APIServer) handlePostByID(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "PATCH" || r.Method == "PUT" {
+		return s.handleUpdatePost(w, r)
+	}
+	if r.Method == "DELETE" {
+		return s.handleDeletePost(w, r)
+	}
+	return methodNotAllowed(r.Method)
+}
+
+// handleUpdatePost handles the request to update a post.
+// @Summary Update a post by ID
+// @Description Updates the given fields of a post. Authors may edit their own posts, admins any post.
+// @Tags posts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Post ID"
+// @Param request body UpdatePostRequest true "Fields to update"
+// @Success 200 {object} Post
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
+// @Router /posts/{id} [patch]
+// @Router /posts/{id} [put]
+func (s *APIServer) handleUpdatePost(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	post, err := s.dbStore.GetPostByID(id)
+	if err != nil {
+		return err
+	}
+	if !s.canEditPost(r, post) {
+		return forbidden("only the author or an admin may change this post")
+	}
+	var req UpdatePostRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	if err := req.Apply(post); err != nil {
+		return err
+	}
+	if err := s.dbStore.UpdatePost(post); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, post)
+}
+
+// handleDeletePost handles the request to delete a post.
+// @Summary Delete a post by ID
+// @Description Authors may delete their own posts, admins any post.
+// @Tags posts
+// @Produce json
+// @Security BearerAuth
+// @Param id path int true "Post ID"
+// @Success 200 {object} map[string]int "deleted":int "Success"
+// @Failure 403 {object} Problem
+// @Router /posts/{id} [delete]
+func (s *APIServer) handleDeletePost(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+	post, err := s.dbStore.GetPostByID(id)
+	if err != nil {
+		return err
+	}
+	if !s.canEditPost(r, post) {
+		return forbidden("only the author or an admin may change this post")
+	}
+	if err := s.dbStore.DeletePost(id); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, map[string]int{"deleted": id})
+}
+
+// handleSearchPosts handles the full-text search request over published posts.
+// @Summary Search published posts
+// @Description Full-text search over post titles and bodies, ranked by relevance. Snippets are escaped HTML with matches in <mark>.
+// @Tags posts
+// @Produce json
+// @Param q query string true "Search text"
+// @Param limit query int false "Maximum number of results (default 20, max 100)"
+// @Success 200 {array} SearchResult
+// @Failure 400 {object} Problem
+// @Router /search [get]
+func (s *APIServer) handleSearchPosts(w http.ResponseWriter, r *http.Request) error {
+	text := strings.TrimSpace(r.URL.Query().Get("q"))
+	if text == "" {
+		return invalidField("q", "is required")
+	}
+	limit := 20
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			return invalidField("limit", "must be between 1 and 100")
+		}
+		limit = n
+	}
+	results, err := s.dbStore.SearchPosts(text, limit)
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, results)
+}
+
+// handleListTags handles the request to list tags.
+// @Summary List tags with the number of published posts per tag
+// @Tags posts
+// @Produce json
+// @Success 200 {array} TagCount
+// @Router /tags [get]
+func (s *APIServer) handleListTags(w http.ResponseWriter, r *http.Request) error {
+	tags, err := s.dbStore.ListTags()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, tags)
+}
+
+// handleListCategories handles the request to list categories.
+// @Summary List categories
+// @Tags posts
+// @Produce json
+// @Success 200 {array} Category
+// @Router /categories [get]
+func (s *APIServer) handleListCategories(w http.ResponseWriter, r *http.Request) error {
+	categories, err := s.dbStore.ListCategories()
+	if err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, categories)
+}
+
+// handleCreateCategory handles the request to create a category.
+// @Summary Create a category
+// @Description Creates a category, optionally below a parent category. Requires the category:manage permission.
+// @Tags posts
+// @Accept json
+// @Produce json
+// @Security BearerAuth
+// @Param request body CategoryRequest true "Category to create"
+// @Success 200 {object} Category
+// @Failure 400 {object} Problem
+// @Failure 403 {object} Problem
+// @Router /categories [post]
+func (s *APIServer) handleCreateCategory(w http.ResponseWriter, r *http.Request) error {
+	var req CategoryRequest
+	if err := s.decodeJSON(w, r, &req); err != nil {
+		return err
+	}
+	category, err := NewCategory(&req)
+	if err != nil {
+		return err
+	}
+	if err := s.dbStore.CreateCategory(category); err != nil {
+		return err
+	}
+	return writeJSON(w, http.StatusOK, category)
+}
+
+// canEditPost reports whether the caller is the post's author or may manage every post.
+func (s *APIServer) canEditPost(r *http.Request, post *Post) bool {
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return false
+	}
+	return caller.ID == post.AuthorID || callerHasPermission(r, s, permManagePost)
+}
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// testMailer keeps the messages it is asked to send.
+type testMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+func (m *testMailer) Send(ctx context.Context, msg Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+// sent returns the messages sent so far.
+func (m *testMailer) sent() []Message {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// testEnv is the full router backed by MemoryDB and an in-process Redis.
+type testEnv struct {
+	t       *testing.T
+	server  *APIServer
+	store   Storage
+	redis   *miniredis.Miniredis
+	mailer  *testMailer
+	handler http.Handler
+}
+
+// newTestEnv starts a test server on a MemoryDB. configure may adjust the default configuration.
+func newTestEnv(t *testing.T, configure ...func(*Config)) *testEnv {
+	return newTestEnvWithStore(t, NewMemoryDB(), configure...)
+}
+
+// newTestEnvWithStore starts a test server on the given store.
+func newTestEnvWithStore(t *testing.T, store Storage, configure ...func(*Config)) *testEnv {
+	t.Helper()
+	cfg := defaultConfig()
+	cfg.Auth.JWTSecret = "test-secret"
+	for _, f := range configure {
+		f(cfg)
+	}
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	mailer := &testMailer{}
+	server := newAPIServer(cfg, store, client, mailer)
+	return &testEnv{t: t, server: server, store: store, redis: mr, mailer: mailer, handler: server.Router()}
+}
+
+// do sends a request with an optional bearer token and JSON body through the router.
+func (e *testEnv) do(method, path, token string, body interface{}) *httptest.ResponseRecorder {
+	e.t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			e.t.Fatal(err)
+		}
+	}
+	req := httptest.NewRequest(method, path, &buf)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	e.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// createAccount stores a verified account directly, bypassing the sign-up flow.
+func (e *testEnv) createAccount(username, password string, roleID int) *Account {
+	e.t.Helper()
+	account, err := NewAccount("Test", "User", username+"@example.com", username, password, "US", roleID)
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	account.EmailVerified = true
+	if err := e.store.CreateAccount(account); err != nil {
+		e.t.Fatal(err)
+	}
+	return account
+}
+
+// login logs in and fails the test unless it succeeds.
+func (e *testEnv) login(username, password string) LoginResponse {
+	e.t.Helper()
+	rec := e.do("POST", "/login", "", LoginRequest{UserName: username, Password: password})
+	if rec.Code != http.StatusOK {
+		e.t.Fatalf("login %s: status %d: %s", username, rec.Code, rec.Body)
+	}
+	return decodeBody[LoginResponse](e.t, rec)
+}
+
+// decodeBody decodes the JSON response body.
+func decodeBody[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var v T
+	if err := json.Unmarshal(rec.Body.Bytes(), &v); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	return v
+}
+
+// expectStatus fails the test unless the response has the wanted status.
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if rec.Code != want {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, want, rec.Body)
+	}
+}
+
+// problemFields returns the names of the fields a problem response rejected.
+func problemFields(t *testing.T, rec *httptest.ResponseRecorder) []string {
+	t.Helper()
+	var fields []string
+	for _, field := range decodeBody[Problem](t, rec).Errors {
+		fields = append(fields, field.Field)
+	}
+	return fields
+}
+
+// linkPattern finds the link in a mailed message.
+var linkPattern = regexp.MustCompile(`https?://\S+`)
+
+// mailedLink returns the path and query of the link in the last mailed message.
+func (e *testEnv) mailedLink() string {
+	e.t.Helper()
+	e.server.background.Wait()
+	sent := e.mailer.sent()
+	if len(sent) == 0 {
+		e.t.Fatal("no mail was sent")
+	}
+	link, err := url.Parse(linkPattern.FindString(sent[len(sent)-1].Body))
+	if err != nil {
+		e.t.Fatal(err)
+	}
+	return link.RequestURI()
+}
+
+func TestUpdateAccountRejectsBlankFields(t *testing.T) {
+	env := newTestEnv(t)
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	login := env.login("alice", "passw0rd1")
+	path := "/account/" + strconv.Itoa(account.ID)
+
+	rec := env.do("PATCH", path, login.Token, map[string]string{"email": "", "country": "", "firstName": "", "password": ""})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := strings.Join(problemFields(t, rec), ","); got != "firstName,email,password,country" {
+		t.Fatalf("rejected fields = %s, want firstName,email,password,country", got)
+	}
+	rec = env.do("PATCH", path, login.Token, map[string]string{"password": "short"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	stored, err := env.store.GetAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Email != account.Email || stored.Country != "US" || !stored.ValidPassword("passw0rd1") {
+		t.Fatalf("account changed by rejected updates: %+v", stored)
+	}
+
+	rec = env.do("PATCH", path, login.Token, map[string]string{"country": "DE"})
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeBody[Account](t, rec).Country; got != "DE" {
+		t.Fatalf("country = %s, want DE", got)
+	}
+}
+
+func TestPasswordsAreLimitedTo72Bytes(t *testing.T) {
+	env := newTestEnv(t)
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+	long := strings.Repeat("é", 40) + "1" // 41 characters, 81 bytes
+
+	rec := env.do("POST", "/account", "", map[string]string{"firstName": "B", "lastName": "C", "email": "bob@example.com",
+		"username": "bob", "password": long, "country": "US"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := strings.Join(problemFields(t, rec), ","); got != "password" {
+		t.Fatalf("rejected fields = %s, want password", got)
+	}
+
+	rec = env.do("POST", "/account/"+strconv.Itoa(account.ID)+"/password", token,
+		ChangePasswordRequest{CurrentPassword: "passw0rd1", NewPassword: long})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := strings.Join(problemFields(t, rec), ","); got != "newPassword" {
+		t.Fatalf("rejected fields = %s, want newPassword", got)
+	}
+
+	rec = env.do("POST", "/password/reset", "", ResetPasswordRequest{Token: "anything", Password: long})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := strings.Join(problemFields(t, rec), ","); got != "password" {
+		t.Fatalf("rejected fields = %s, want password", got)
+	}
+}
+
+func TestDuplicatesAreConflicts(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	bob := env.createAccount("bob", "passw0rd1", roleUser)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	signUp := func(username, email string) *httptest.ResponseRecorder {
+		return env.do("POST", "/account", "", map[string]string{"firstName": "A", "lastName": "B", "email": email,
+			"username": username, "password": "passw0rd1", "country": "US"})
+	}
+
+	// Usernames and e-mail addresses are unique regardless of case
+	rec := signUp("ALICE", "new@example.com")
+	expectStatus(t, rec, http.StatusConflict)
+	if got := strings.Join(problemFields(t, rec), ","); got != "username" {
+		t.Fatalf("conflicting fields = %s, want username", got)
+	}
+	rec = signUp("carol", "Alice@Example.com")
+	expectStatus(t, rec, http.StatusConflict)
+	if got := strings.Join(problemFields(t, rec), ","); got != "email" {
+		t.Fatalf("conflicting fields = %s, want email", got)
+	}
+	rec = env.do("PATCH", "/account/"+strconv.Itoa(bob.ID), env.login("bob", "passw0rd1").Token,
+		map[string]string{"email": "alice@example.com"})
+	expectStatus(t, rec, http.StatusConflict)
+
+	token := env.login("admin", "passw0rd1").Token
+	expectStatus(t, env.do("POST", "/posts", token, PostRequest{Title: "Go basics"}), http.StatusOK)
+	expectStatus(t, env.do("POST", "/posts", token, PostRequest{Title: "Go Basics!"}), http.StatusConflict)
+	expectStatus(t, env.do("POST", "/posts", token, PostRequest{Title: "Other", Slug: "go-basics"}), http.StatusConflict)
+	expectStatus(t, env.do("POST", "/categories", token, CategoryRequest{Name: "Go"}), http.StatusOK)
+	expectStatus(t, env.do("POST", "/categories", token, CategoryRequest{Name: "go"}), http.StatusConflict)
+}
+
+func TestUpdateAccountPassword(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createAccount("alice", "passw0rd1", roleUser)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	old := env.login("alice", "passw0rd1")
+	path := "/account/" + strconv.Itoa(alice.ID)
+
+	rec := env.do("PATCH", path, old.Token, map[string]string{"password": "n3wpassword", "country": "DE"})
+	expectStatus(t, rec, http.StatusOK)
+	if got := decodeBody[Account](t, rec).Country; got != "DE" {
+		t.Fatalf("country = %s, want DE", got)
+	}
+
+	// Every earlier session ends with the password change, including the one that made it
+	expectStatus(t, env.do("GET", "/me", old.Token, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: old.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"}), http.StatusUnauthorized)
+	fresh := env.login("alice", "n3wpassword")
+
+	// Admins can set the password of other accounts
+	rec = env.do("PATCH", path, env.login("admin", "passw0rd1").Token, map[string]string{"password": "adm1nchosen"})
+	expectStatus(t, rec, http.StatusOK)
+	expectStatus(t, env.do("GET", "/me", fresh.Token, nil), http.StatusUnauthorized)
+	env.login("alice", "adm1nchosen")
+}
+
+func TestConcurrentUpdateDoesNotUndoPasswordChange(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+
+	// An update that read the account before the password change writes its copy back afterwards
+	stale, err := env.store.GetAccountByID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := hashPassword("n3wpassword")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.server.setPassword(context.Background(), alice.ID, hash); err != nil {
+		t.Fatal(err)
+	}
+	stale.Country = "DE"
+	if err := env.store.UpdateAccount(stale); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, env.do("GET", "/me", token, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"}), http.StatusUnauthorized)
+	env.login("alice", "n3wpassword")
+}
+
+func TestAccountAccessIsLimitedToOwnerAndAdmins(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createAccount("alice", "passw0rd1", roleUser)
+	bob := env.createAccount("bob", "passw0rd1", roleUser)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+
+	aliceToken := env.login("alice", "passw0rd1").Token
+	adminToken := env.login("admin", "passw0rd1").Token
+
+	expectStatus(t, env.do("GET", "/account/"+strconv.Itoa(alice.ID), aliceToken, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/account/"+strconv.Itoa(bob.ID), aliceToken, nil), http.StatusForbidden)
+	expectStatus(t, env.do("GET", "/account/"+strconv.Itoa(bob.ID), adminToken, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/account", aliceToken, nil), http.StatusForbidden)
+	expectStatus(t, env.do("GET", "/me", "", nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/me", "not-a-token", nil), http.StatusUnauthorized)
+}
+
+func TestRoleAndPermissionGuards(t *testing.T) {
+	env := newTestEnv(t)
+	const roleSupport = 3
+	env.store.(*MemoryDB).roles[roleSupport] = &Role{ID: roleSupport, Name: "support", Permissions: []string{permManageAccount}}
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	env.createAccount("sam", "passw0rd1", roleSupport)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	adminToken := env.login("admin", "passw0rd1").Token
+	supportToken := env.login("sam", "passw0rd1").Token
+	userToken := env.login("alice", "passw0rd1").Token
+
+	// Lifting a lock takes the account:manage permission, which the support role grants
+	expectStatus(t, env.do("DELETE", "/lockouts?username=bob", supportToken, nil), http.StatusNoContent)
+	expectStatus(t, env.do("DELETE", "/lockouts?username=bob", userToken, nil), http.StatusForbidden)
+
+	// The lockout event log is for the admin role only
+	expectStatus(t, env.do("GET", "/lockouts/events", adminToken, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/lockouts/events", supportToken, nil), http.StatusForbidden)
+	expectStatus(t, env.do("GET", "/lockouts/events", "", nil), http.StatusUnauthorized)
+}
+
+// failingStore is a MemoryDB whose account lookups by username fail.
+type failingStore struct {
+	*MemoryDB
+}
+
+func (s failingStore) GetAccountByUsername(username string) (*Account, error) {
+	return nil, errors.New("connection refused")
+}
+
+func TestListPostsByAuthor(t *testing.T) {
+	env := newTestEnv(t)
+	rec := env.do("GET", "/posts?author=nobody", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if posts := decodeBody[[]*Post](t, rec); len(posts) != 0 {
+		t.Fatalf("unknown author has %d posts", len(posts))
+	}
+
+	env = newTestEnvWithStore(t, failingStore{NewMemoryDB()})
+	rec = env.do("GET", "/posts?author=alice", "", nil)
+	expectStatus(t, rec, http.StatusInternalServerError)
+	if strings.Contains(rec.Body.String(), "connection refused") {
+		t.Fatalf("internal error reached the client: %s", rec.Body)
+	}
+}
+
+func TestCreatePostValidatesLengths(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+
+	rec := env.do("POST", "/posts", token, PostRequest{Title: strings.Repeat("a", 256)})
+	expectStatus(t, rec, http.StatusBadRequest)
+	rec = env.do("POST", "/posts", token, PostRequest{Title: "Go", Tags: []string{strings.Repeat("t", 101)}})
+	expectStatus(t, rec, http.StatusBadRequest)
+	expectStatus(t, env.do("POST", "/posts", token, PostRequest{Title: "Go", Tags: []string{"go"}}), http.StatusOK)
+}
+
+// blockingMailer holds every message until release is closed.
+type blockingMailer struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+	sent    atomic.Int32
+}
+
+func newBlockingMailer() *blockingMailer {
+	return &blockingMailer{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (m *blockingMailer) Send(ctx context.Context, msg Message) error {
+	m.once.Do(func() { close(m.started) })
+	select {
+	case <-m.release:
+		m.sent.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// shutDownWithMailPending starts a reset mail that blocks in mailer, then starts serving and stops at once.
+// It returns the result of serve.
+func shutDownWithMailPending(t *testing.T, env *testEnv, mailer *blockingMailer) <-chan error {
+	t.Helper()
+	env.server.mailer = mailer
+	env.createAccount("alice", "passw0rd1", roleUser)
+	expectStatus(t, env.do("POST", "/password/forgot", "", map[string]string{"email": "alice@example.com"}), http.StatusAccepted)
+	<-mailer.started
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- env.server.serve(ctx) }()
+	cancel()
+	return done
+}
+
+func TestShutdownWaitsForBackgroundMail(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) { cfg.ListenAddr = "127.0.0.1:0" })
+	mailer := newBlockingMailer()
+	done := shutDownWithMailPending(t, env, mailer)
+	select {
+	case err := <-done:
+		t.Fatalf("serve returned %v while a mail was still being sent", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(mailer.release)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("serve = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve did not return after the mail was sent")
+	}
+	if n := mailer.sent.Load(); n != 1 {
+		t.Fatalf("%d mails sent, want 1", n)
+	}
+}
+
+func TestShutdownGivesUpOnBackgroundWorkAfterTimeout(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) {
+		cfg.ListenAddr = "127.0.0.1:0"
+		cfg.Server.ShutdownTimeout = 50 * time.Millisecond
+	})
+	mailer := newBlockingMailer()
+	t.Cleanup(func() { close(mailer.release) })
+	select {
+	case err := <-shutDownWithMailPending(t, env, mailer):
+		if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "background tasks") {
+			t.Fatalf("serve = %v, want the background wait to time out", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve waited past the shutdown timeout")
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	redis "github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+var (
+	accountCacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "account_cache_lookups_total",
+		Help:      "Account cache lookups by result: hit or miss.",
+	}, []string{"result"})
+	// accountCacheLoads counts database queries, which stay below misses when concurrent misses are collapsed
+	accountCacheLoads = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "account_cache_loads_total",
+		Help:      "Database queries made to fill the account cache.",
+	})
+	accountCacheErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "account_cache_errors_total",
+		Help:      "Failed reads and invalidations of the account cache.",
+	})
+)
+
+// cachedAccount is the cached form of an Account. It keeps every field the API hides except the
+// password hash, which never leaves the database.
+type cachedAccount struct {
+	ID            int       `json:"id"`
+	FirstName     string    `json:"firstName"`
+	LastName      string    `json:"lastName"`
+	Email         string    `json:"email"`
+	Username      string    `json:"username"`
+	Country       string    `json:"country"`
+	RoleID        int       `json:"roleId"`
+	CreatedAt     time.Time `json:"createdAt"`
+	EmailVerified bool      `json:"emailVerified"`
+	TokenVersion  int       `json:"tokenVersion"`
+}
+
+// newCachedAccount returns the cached form of account.
+func newCachedAccount(account *Account) cachedAccount {
+	return cachedAccount{
+		ID:            account.ID,
+		FirstName:     account.FirstName,
+		LastName:      account.LastName,
+		Email:         account.Email,
+		Username:      account.Username,
+		Country:       account.Country,
+		RoleID:        account.RoleID,
+		CreatedAt:     account.CreatedAt,
+		EmailVerified: account.EmailVerified,
+		TokenVersion:  account.TokenVersion,
+	}
+}
+
+// account returns the cached account. Its EncryptedPassword is empty.
+func (c cachedAccount) account() *Account {
+	return &Account{
+		ID:            c.ID,
+		FirstName:     c.FirstName,
+		LastName:      c.LastName,
+		Email:         c.Email,
+		Username:      c.Username,
+		Country:       c.Country,
+		RoleID:        c.RoleID,
+		CreatedAt:     c.CreatedAt,
+		EmailVerified: c.EmailVerified,
+		TokenVersion:  c.TokenVersion,
+	}
+}
+
+// accountGenerationTTL is how long the generation of an account is kept after its last change.
+// It only has to outlast the slowest load, since a missing generation never matches a read one.
+const accountGenerationTTL = 24 * time.Hour
+
+// fillAccountCache stores a loaded account only if its generation has not moved since the load began,
+// so a load that read the row before a concurrent update cannot put the old row back.
+var fillAccountCache = redis.NewScript(`
+local generation = redis.call('GET', KEYS[2]) or ''
+if generation ~= ARGV[1] then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1
+`)
+
+// CachedStorage is a Storage that serves GetAccountByID through a Redis read-through cache.
+// Every other method goes straight to the wrapped Storage. Entries are dropped when the account
+// is updated or deleted and expire after ttl. Each change also bumps the account's generation,
+// which keeps loads that raced with it from caching what they read.
+// Accounts served from the cache have no password hash, which UpdateAccount never writes anyway.
+// Lookups, loads and errors are counted as Prometheus metrics, so they are only visible with metrics enabled.
+type CachedStorage struct {
+	Storage
+	client *redis.Client
+	ttl    time.Duration
+	group  singleflight.Group
+}
+
+// NewCachedStorage wraps store with an account cache kept in Redis for ttl.
+func NewCachedStorage(store Storage, client *redis.Client, ttl time.Duration) *CachedStorage {
+	return &CachedStorage{Storage: store, client: client, ttl: ttl}
+}
+
+// accountCacheKey returns the Redis key of a cached account.
+func accountCacheKey(id int) string {
+	return fmt.Sprintf("cache:account:%d", id)
+}
+
+// accountGenerationKey returns the Redis key counting the changes of an account.
+func accountGenerationKey(id int) string {
+	return fmt.Sprintf("cache:account:%d:generation", id)
+}
+
+// GetAccountByID returns the account from the cache, loading and caching it on a miss.
+// Concurrent misses for the same account share one database query.
+func (s *CachedStorage) GetAccountByID(id int) (*Account, error) {
+	ctx := context.Background()
+	data, err := s.client.Get(ctx, accountCacheKey(id)).Bytes()
+	if err == nil {
+		var cached cachedAccount
+		if err := json.Unmarshal(data, &cached); err == nil {
+			accountCacheLookups.WithLabelValues("hit").Inc()
+			return cached.account(), nil
+		}
+	} else if err != redis.Nil {
+		// A cache outage degrades to plain database reads
+		accountCacheErrors.Inc()
+		log.Printf("account cache: %v", err)
+	}
+	accountCacheLookups.WithLabelValues("miss").Inc()
+	v, err, _ := s.group.Do(strconv.Itoa(id), func() (interface{}, error) {
+		accountCacheLoads.Inc()
+		// The generation is read before the row, so an update landing in between is noticed
+		generation, err := s.client.Get(ctx, accountGenerationKey(id)).Result()
+		if err != nil && err != redis.Nil {
+			log.Printf("account cache: %v", err)
+			return s.Storage.GetAccountByID(id)
+		}
+		account, err := s.Storage.GetAccountByID(id)
+		if err != nil {
+			return nil, err
+		}
+		if data, err := json.Marshal(newCachedAccount(account)); err == nil {
+			keys := []string{accountCacheKey(id), accountGenerationKey(id)}
+			if err := fillAccountCache.Run(ctx, s.client, keys, generation, data, s.ttl.Milliseconds()).Err(); err != nil {
+				log.Printf("account cache: %v", err)
+			}
+		}
+		return account, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Callers may modify the account, so each gets its own copy
+	account := *v.(*Account)
+	return &account, nil
+}
+
+// UpdateAccount updates the account and drops it from the cache.
+func (s *CachedStorage) UpdateAccount(account *Account) error {
+	err := s.Storage.UpdateAccount(account)
+	s.invalidate(account.ID)
+	return err
+}
+
+// BumpTokenVersion bumps the token version and drops the account from the cache.
+func (s *CachedStorage) BumpTokenVersion(id int) (int, error) {
+	version, err := s.Storage.BumpTokenVersion(id)
+	s.invalidate(id)
+	return version, err
+}
+
+// SetPassword stores the new password hash and drops the account from the cache.
+func (s *CachedStorage) SetPassword(id int, hash string) (int, error) {
+	version, err := s.Storage.SetPassword(id, hash)
+	s.invalidate(id)
+	return version, err
+}
+
+// DeleteAccount deletes the account and drops it from the cache.
+func (s *CachedStorage) DeleteAccount(id int) error {
+	err := s.Storage.DeleteAccount(id)
+	s.invalidate(id)
+	return err
+}
+
+// invalidate drops a cached account and bumps its generation, so loads still in flight do not cache it again.
+func (s *CachedStorage) invalidate(id int) {
+	_, err := s.client.TxPipelined(context.Background(), func(pipe redis.Pipeliner) error {
+		pipe.Incr(context.Background(), accountGenerationKey(id))
+		pipe.Expire(context.Background(), accountGenerationKey(id), accountGenerationTTL)
+		pipe.Del(context.Background(), accountCacheKey(id))
+		return nil
+	})
+	if err != nil {
+		accountCacheErrors.Inc()
+		log.Printf("account cache: dropping account %d: %v", id, err)
+	}
+}
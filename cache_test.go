@@ -0,0 +1,165 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// pausingStore holds the next GetAccountByID after it has read the row, until release is closed.
+type pausingStore struct {
+	*MemoryDB
+	once    sync.Once
+	loaded  chan struct{}
+	release chan struct{}
+}
+
+func (s *pausingStore) GetAccountByID(id int) (*Account, error) {
+	account, err := s.MemoryDB.GetAccountByID(id)
+	s.once.Do(func() {
+		close(s.loaded)
+		<-s.release
+	})
+	return account, err
+}
+
+func newTestCache(t *testing.T, store Storage) (*CachedStorage, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return NewCachedStorage(store, client, time.Minute), mr
+}
+
+func TestCachedStorageKeepsHashOutOfRedis(t *testing.T) {
+	db := NewMemoryDB()
+	account, err := NewAccount("A", "B", "a@b.co", "alice", "passw0rd1", "US", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	cache, mr := newTestCache(t, db)
+	if _, err := cache.GetAccountByID(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := mr.Get(accountCacheKey(account.ID))
+	if err != nil {
+		t.Fatalf("account was not cached: %v", err)
+	}
+	if strings.Contains(cached, account.EncryptedPassword) || strings.Contains(cached, "hash") {
+		t.Fatalf("cache entry holds the password hash: %s", cached)
+	}
+
+	// Saving an account read from the cache must not wipe its password
+	hit, err := cache.GetAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hit.FirstName = "Alicia"
+	if err := cache.UpdateAccount(hit); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := db.GetAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !stored.ValidPassword("passw0rd1") {
+		t.Fatal("updating a cached account cleared its password")
+	}
+}
+
+func TestCachedStorageRacingLoadDoesNotCacheOldRow(t *testing.T) {
+	db := NewMemoryDB()
+	account, err := NewAccount("A", "B", "a@b.co", "alice", "passw0rd1", "US", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	store := &pausingStore{MemoryDB: db, loaded: make(chan struct{}), release: make(chan struct{})}
+	cache, _ := newTestCache(t, store)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		cache.GetAccountByID(account.ID)
+	}()
+	<-store.loaded
+
+	// The load above has read version 0; revoke all tokens before it stores what it read
+	if _, err := cache.BumpTokenVersion(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	close(store.release)
+	<-done
+
+	got, err := cache.GetAccountByID(account.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TokenVersion != 1 {
+		t.Fatalf("TokenVersion = %d after the update, want 1: the racing load cached the old row", got.TokenVersion)
+	}
+}
+
+func TestCachedStorageCounters(t *testing.T) {
+	db := NewMemoryDB()
+	account, err := NewAccount("A", "B", "a@b.co", "alice", "passw0rd1", "US", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.CreateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	cache, mr := newTestCache(t, db)
+	// The counters are shared by the whole test binary, so only their growth is checked
+	counts := func() [4]float64 {
+		return [4]float64{
+			testutil.ToFloat64(accountCacheLookups.WithLabelValues("hit")),
+			testutil.ToFloat64(accountCacheLookups.WithLabelValues("miss")),
+			testutil.ToFloat64(accountCacheLoads),
+			testutil.ToFloat64(accountCacheErrors),
+		}
+	}
+	expect := func(before [4]float64, hits, misses, loads, errs float64) {
+		t.Helper()
+		after := counts()
+		if got := [4]float64{after[0] - before[0], after[1] - before[1], after[2] - before[2], after[3] - before[3]}; got != [4]float64{hits, misses, loads, errs} {
+			t.Fatalf("hits, misses, loads, errors grew by %v, want %v", got, [4]float64{hits, misses, loads, errs})
+		}
+	}
+
+	before := counts()
+	for i := 0; i < 3; i++ {
+		if _, err := cache.GetAccountByID(account.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect(before, 2, 1, 1, 0)
+
+	// An update drops the entry, so the next lookup misses again
+	before = counts()
+	if err := cache.UpdateAccount(account); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cache.GetAccountByID(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect(before, 0, 1, 1, 0)
+
+	// Without Redis lookups fall through to the database and count as errors
+	before = counts()
+	mr.Close()
+	if _, err := cache.GetAccountByID(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	expect(before, 0, 1, 1, 1)
+}
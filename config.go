@@ -0,0 +1,572 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the settings of the server. It is loaded by LoadConfig.
+type Config struct {
+	ListenAddr        string           `yaml:"listenAddr"`
+	PublicURL         string           `yaml:"publicURL"`
+	TrustProxyHeaders bool             `yaml:"trustProxyHeaders"` // take client IPs from X-Forwarded-For, only behind a proxy
+	Server            ServerConfig     `yaml:"server"`
+	Database          DatabaseConfig   `yaml:"database"`
+	Redis             RedisConfig      `yaml:"redis"`
+	Auth              AuthConfig       `yaml:"auth"`
+	Validation        ValidationConfig `yaml:"validation"`
+	Mail              MailConfig       `yaml:"mail"`
+	RateLimit         RateLimitConfig  `yaml:"rateLimit"`
+	Cache             CacheConfig      `yaml:"cache"`
+	Metrics           MetricsConfig    `yaml:"metrics"`
+}
+
+// ServerConfig holds the HTTP server timeouts.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"` // how long in-flight requests may take to drain
+}
+
+// DatabaseConfig holds the PostgreSQL connection settings.
+type DatabaseConfig struct {
+	DSN             string        `yaml:"dsn"`
+	MaxOpenConns    int           `yaml:"maxOpenConns"`
+	MaxIdleConns    int           `yaml:"maxIdleConns"`
+	ConnMaxLifetime time.Duration `yaml:"connMaxLifetime"`
+	ConnectTimeout  time.Duration `yaml:"connectTimeout"` // how long startup keeps retrying
+}
+
+// RedisConfig holds the Redis connection settings.
+type RedisConfig struct {
+	Addr           string        `yaml:"addr"`
+	Password       string        `yaml:"password"`
+	DB             int           `yaml:"db"`
+	ConnectTimeout time.Duration `yaml:"connectTimeout"` // how long startup keeps retrying
+}
+
+// AuthConfig holds the token lifetimes and signing keys.
+type AuthConfig struct {
+	AccessTokenTTL  time.Duration `yaml:"accessTokenTTL"`
+	RefreshTokenTTL time.Duration `yaml:"refreshTokenTTL"`
+	// JWTSecret signs HS256 access tokens when no SigningKeys are set. It always keys
+	// the e-mail and CSRF tokens, so it is required in every mode.
+	JWTSecret string `yaml:"jwtSecret"`
+	// SigningKeys switches access tokens to RS256 or EdDSA. Tokens are signed with ActiveKey
+	// (the first key by default); the other keys only verify tokens issued before a rotation.
+	SigningKeys []SigningKeyConfig `yaml:"signingKeys"`
+	ActiveKey   string             `yaml:"activeKey"`
+
+	EmailVerificationTTL time.Duration `yaml:"emailVerificationTTL"`
+	PasswordResetTTL     time.Duration `yaml:"passwordResetTTL"`
+
+	// LegacyTokenHeader keeps accepting the deprecated "token" header next to Authorization: Bearer.
+	LegacyTokenHeader bool         `yaml:"legacyTokenHeader"`
+	Cookie            CookieConfig `yaml:"cookie"`
+
+	Lockout LockoutConfig `yaml:"lockout"`
+
+	keys *keySet // loaded from SigningKeys by LoadConfig
+}
+
+// LockoutConfig controls the login brute-force protection. After MaxAttempts failed logins for a username,
+// or IPMaxAttempts from one client IP, further logins are refused for BaseDelay, doubling with every further
+// failure up to MaxDelay. Failures are forgotten after Window without a new one.
+type LockoutConfig struct {
+	MaxAttempts   int           `yaml:"maxAttempts"`
+	IPMaxAttempts int           `yaml:"ipMaxAttempts"`
+	BaseDelay     time.Duration `yaml:"baseDelay"`
+	MaxDelay      time.Duration `yaml:"maxDelay"`
+	Window        time.Duration `yaml:"window"`
+}
+
+// CacheConfig controls the Redis read-through cache in front of the database.
+type CacheConfig struct {
+	AccountTTL time.Duration `yaml:"accountTTL"` // zero turns the account cache off
+}
+
+// MetricsConfig controls the Prometheus endpoint at /metrics. It is off unless enabled with a token.
+type MetricsConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Token   string `yaml:"token"` // bearer token scrapes must send
+}
+
+// RateLimitConfig sets the request limits. Routes override Default and are keyed by method and
+// route template, for example "POST /account" or "GET /account/{id}".
+type RateLimitConfig struct {
+	Enabled bool                     `yaml:"enabled"`
+	Default RateLimitRule            `yaml:"default"`
+	Routes  map[string]RateLimitRule `yaml:"routes"`
+}
+
+// RateLimitRule allows Requests per sliding Window. Zero Requests turns limiting off.
+type RateLimitRule struct {
+	Requests int           `yaml:"requests"`
+	Window   time.Duration `yaml:"window"`
+}
+
+// SigningKeyConfig names a PEM file holding an RSA or Ed25519 key. A public key is enough for retired keys.
+type SigningKeyConfig struct {
+	ID   string `yaml:"id"`
+	File string `yaml:"file"`
+}
+
+// CookieConfig controls the optional cookie mode, where /login stores the access token in an HttpOnly cookie
+// and requests authenticated by that cookie must echo the CSRF token.
+type CookieConfig struct {
+	Enabled  bool   `yaml:"enabled"`
+	Name     string `yaml:"name"`
+	Domain   string `yaml:"domain"`
+	Secure   bool   `yaml:"secure"`
+	SameSite string `yaml:"sameSite"` // strict, lax or none
+}
+
+// MailConfig selects and configures the Mailer. Driver is one of log, file or smtp.
+type MailConfig struct {
+	Driver       string `yaml:"driver"`
+	From         string `yaml:"from"`
+	Dir          string `yaml:"dir"` // output directory of the file driver
+	SMTPAddr     string `yaml:"smtpAddr"`
+	SMTPUsername string `yaml:"smtpUsername"`
+	SMTPPassword string `yaml:"smtpPassword"`
+}
+
+// ValidationConfig holds the limits applied to request bodies.
+type ValidationConfig struct {
+	MaxBodyBytes int64          `yaml:"maxBodyBytes"`
+	Password     PasswordPolicy `yaml:"password"`
+}
+
+// PasswordPolicy describes what a new password must contain.
+type PasswordPolicy struct {
+	MinLength     int  `yaml:"minLength"`
+	RequireUpper  bool `yaml:"requireUpper"`
+	RequireLower  bool `yaml:"requireLower"`
+	RequireDigit  bool `yaml:"requireDigit"`
+	RequireSymbol bool `yaml:"requireSymbol"`
+}
+
+// defaultConfig returns the settings used when neither the config file nor the environment sets them.
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddr: ":1234",
+		Server: ServerConfig{
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   20 * time.Second,
+		},
+		PublicURL: "http://localhost:1234",
+		Database: DatabaseConfig{
+			DSN:             "user=postgres dbname=postgres sslmode=disable",
+			MaxOpenConns:    25,
+			MaxIdleConns:    25,
+			ConnMaxLifetime: 5 * time.Minute,
+			ConnectTimeout:  30 * time.Second,
+		},
+		Redis: RedisConfig{
+			Addr:           "localhost:6379",
+			ConnectTimeout: 30 * time.Second,
+		},
+		Auth: AuthConfig{
+			AccessTokenTTL:  1 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+
+			EmailVerificationTTL: 24 * time.Hour,
+			PasswordResetTTL:     time.Hour,
+
+			LegacyTokenHeader: true,
+			Cookie: CookieConfig{
+				Name:     "access_token",
+				Secure:   true,
+				SameSite: "strict",
+			},
+			Lockout: LockoutConfig{
+				MaxAttempts:   5,
+				IPMaxAttempts: 50,
+				BaseDelay:     time.Minute,
+				MaxDelay:      time.Hour,
+				Window:        15 * time.Minute,
+			},
+		},
+		Validation: ValidationConfig{
+			MaxBodyBytes: 1 << 20,
+			Password: PasswordPolicy{
+				MinLength:    8,
+				RequireDigit: true,
+			},
+		},
+		RateLimit: RateLimitConfig{
+			Enabled: true,
+			Default: RateLimitRule{Requests: 300, Window: time.Minute},
+			Routes: map[string]RateLimitRule{
+				"POST /account":         {Requests: 10, Window: time.Hour},
+				"GET /account":          {Requests: 60, Window: time.Minute},
+				"POST /password/forgot": {Requests: 5, Window: time.Hour},
+				// Probes are never throttled
+				"GET /healthz": {},
+				"GET /readyz":  {},
+				"GET /metrics": {},
+			},
+		},
+		Cache: CacheConfig{
+			AccountTTL: time.Minute,
+		},
+		Mail: MailConfig{
+			Driver: "log",
+			From:   "Dev-Tasks <no-reply@localhost>",
+			Dir:    "mail",
+		},
+	}
+}
+
+// LoadConfig builds the configuration from the defaults, the optional YAML or JSON file at path
+// and the environment, in that order of precedence, and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	keys, err := loadKeySet(cfg.Auth)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Auth.keys = keys
+	return cfg, nil
+}
+
+// LoadMigrateConfig reads the configuration like LoadConfig but only validates the database settings,
+// so the migrate subcommand runs without the secrets the server needs.
+func LoadMigrateConfig(path string) (*Config, error) {
+	cfg, err := readConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Database.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
+}
+
+// readConfig starts from the defaults and applies the optional file and then the environment.
+func readConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		// JSON is a subset of YAML, so one decoder handles both formats
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+	if err := cfg.applyEnv(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the settings with the environment variables that are set.
+func (cfg *Config) applyEnv() error {
+	var errs []error
+	envString("LISTEN_ADDR", &cfg.ListenAddr)
+	envString("PUBLIC_URL", &cfg.PublicURL)
+	errs = append(errs, envBool("TRUST_PROXY_HEADERS", &cfg.TrustProxyHeaders))
+	errs = append(errs, envDuration("SERVER_READ_TIMEOUT", &cfg.Server.ReadTimeout))
+	errs = append(errs, envDuration("SERVER_READ_HEADER_TIMEOUT", &cfg.Server.ReadHeaderTimeout))
+	errs = append(errs, envDuration("SERVER_WRITE_TIMEOUT", &cfg.Server.WriteTimeout))
+	errs = append(errs, envDuration("SERVER_IDLE_TIMEOUT", &cfg.Server.IdleTimeout))
+	errs = append(errs, envDuration("SERVER_SHUTDOWN_TIMEOUT", &cfg.Server.ShutdownTimeout))
+	envString("DATABASE_DSN", &cfg.Database.DSN)
+	errs = append(errs, envInt("DATABASE_MAX_OPEN_CONNS", &cfg.Database.MaxOpenConns))
+	errs = append(errs, envInt("DATABASE_MAX_IDLE_CONNS", &cfg.Database.MaxIdleConns))
+	errs = append(errs, envDuration("DATABASE_CONN_MAX_LIFETIME", &cfg.Database.ConnMaxLifetime))
+	errs = append(errs, envDuration("DATABASE_CONNECT_TIMEOUT", &cfg.Database.ConnectTimeout))
+	envString("REDIS_ADDR", &cfg.Redis.Addr)
+	envString("REDIS_PASSWORD", &cfg.Redis.Password)
+	errs = append(errs, envInt("REDIS_DB", &cfg.Redis.DB))
+	errs = append(errs, envDuration("REDIS_CONNECT_TIMEOUT", &cfg.Redis.ConnectTimeout))
+	errs = append(errs, envDuration("ACCESS_TOKEN_TTL", &cfg.Auth.AccessTokenTTL))
+	errs = append(errs, envDuration("REFRESH_TOKEN_TTL", &cfg.Auth.RefreshTokenTTL))
+	// bank_secret is the variable name used before the configuration existed
+	envString("bank_secret", &cfg.Auth.JWTSecret)
+	envString("JWT_SECRET", &cfg.Auth.JWTSecret)
+	errs = append(errs, envSigningKeys("JWT_SIGNING_KEYS", &cfg.Auth.SigningKeys))
+	envString("JWT_ACTIVE_KEY", &cfg.Auth.ActiveKey)
+	errs = append(errs, envDuration("EMAIL_VERIFICATION_TTL", &cfg.Auth.EmailVerificationTTL))
+	errs = append(errs, envDuration("PASSWORD_RESET_TTL", &cfg.Auth.PasswordResetTTL))
+	errs = append(errs, envBool("LEGACY_TOKEN_HEADER", &cfg.Auth.LegacyTokenHeader))
+	errs = append(errs, envBool("AUTH_COOKIE_ENABLED", &cfg.Auth.Cookie.Enabled))
+	envString("AUTH_COOKIE_NAME", &cfg.Auth.Cookie.Name)
+	envString("AUTH_COOKIE_DOMAIN", &cfg.Auth.Cookie.Domain)
+	errs = append(errs, envBool("AUTH_COOKIE_SECURE", &cfg.Auth.Cookie.Secure))
+	envString("AUTH_COOKIE_SAMESITE", &cfg.Auth.Cookie.SameSite)
+	errs = append(errs, envInt("LOCKOUT_MAX_ATTEMPTS", &cfg.Auth.Lockout.MaxAttempts))
+	errs = append(errs, envInt("LOCKOUT_IP_MAX_ATTEMPTS", &cfg.Auth.Lockout.IPMaxAttempts))
+	errs = append(errs, envDuration("LOCKOUT_BASE_DELAY", &cfg.Auth.Lockout.BaseDelay))
+	errs = append(errs, envDuration("LOCKOUT_MAX_DELAY", &cfg.Auth.Lockout.MaxDelay))
+	errs = append(errs, envDuration("LOCKOUT_WINDOW", &cfg.Auth.Lockout.Window))
+	errs = append(errs, envInt64("MAX_BODY_BYTES", &cfg.Validation.MaxBodyBytes))
+	errs = append(errs, envInt("PASSWORD_MIN_LENGTH", &cfg.Validation.Password.MinLength))
+	errs = append(errs, envBool("PASSWORD_REQUIRE_UPPER", &cfg.Validation.Password.RequireUpper))
+	errs = append(errs, envBool("PASSWORD_REQUIRE_LOWER", &cfg.Validation.Password.RequireLower))
+	errs = append(errs, envBool("PASSWORD_REQUIRE_DIGIT", &cfg.Validation.Password.RequireDigit))
+	errs = append(errs, envBool("PASSWORD_REQUIRE_SYMBOL", &cfg.Validation.Password.RequireSymbol))
+	errs = append(errs, envBool("RATE_LIMIT_ENABLED", &cfg.RateLimit.Enabled))
+	errs = append(errs, envInt("RATE_LIMIT_REQUESTS", &cfg.RateLimit.Default.Requests))
+	errs = append(errs, envDuration("RATE_LIMIT_WINDOW", &cfg.RateLimit.Default.Window))
+	errs = append(errs, envDuration("ACCOUNT_CACHE_TTL", &cfg.Cache.AccountTTL))
+	errs = append(errs, envBool("METRICS_ENABLED", &cfg.Metrics.Enabled))
+	envString("METRICS_TOKEN", &cfg.Metrics.Token)
+	envString("MAIL_DRIVER", &cfg.Mail.Driver)
+	envString("MAIL_FROM", &cfg.Mail.From)
+	envString("MAIL_DIR", &cfg.Mail.Dir)
+	envString("SMTP_ADDR", &cfg.Mail.SMTPAddr)
+	envString("SMTP_USERNAME", &cfg.Mail.SMTPUsername)
+	envString("SMTP_PASSWORD", &cfg.Mail.SMTPPassword)
+	return errors.Join(errs...)
+}
+
+// Validate checks that the configuration is usable and reports every problem found.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if cfg.ListenAddr == "" {
+		errs = append(errs, fmt.Errorf("listenAddr must be set"))
+	}
+	if cfg.Server.ReadTimeout <= 0 || cfg.Server.ReadHeaderTimeout <= 0 || cfg.Server.WriteTimeout <= 0 || cfg.Server.IdleTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server timeouts must be positive"))
+	}
+	if cfg.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("server.shutdownTimeout must be positive"))
+	}
+	errs = append(errs, cfg.Database.validate())
+	if cfg.Redis.Addr == "" {
+		errs = append(errs, fmt.Errorf("redis.addr must be set"))
+	}
+	if cfg.Redis.ConnectTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("redis.connectTimeout must be positive"))
+	}
+	if cfg.Redis.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis.db must not be negative"))
+	}
+	if cfg.Auth.AccessTokenTTL <= 0 {
+		errs = append(errs, fmt.Errorf("auth.accessTokenTTL must be positive"))
+	}
+	if cfg.Auth.RefreshTokenTTL <= cfg.Auth.AccessTokenTTL {
+		errs = append(errs, fmt.Errorf("auth.refreshTokenTTL must be longer than auth.accessTokenTTL"))
+	}
+	if cfg.Auth.JWTSecret == "" {
+		errs = append(errs, fmt.Errorf("auth.jwtSecret must be set (JWT_SECRET)"))
+	}
+	seen := make(map[string]bool)
+	for _, key := range cfg.Auth.SigningKeys {
+		if key.ID == "" || key.File == "" {
+			errs = append(errs, fmt.Errorf("auth.signingKeys entries need an id and a file"))
+		} else if seen[key.ID] {
+			errs = append(errs, fmt.Errorf("auth.signingKeys: duplicate id %s", key.ID))
+		}
+		seen[key.ID] = true
+	}
+	if cfg.Auth.ActiveKey != "" && !seen[cfg.Auth.ActiveKey] {
+		errs = append(errs, fmt.Errorf("auth.activeKey %s is not one of auth.signingKeys", cfg.Auth.ActiveKey))
+	}
+	if cfg.Auth.Lockout.MaxAttempts < 1 || cfg.Auth.Lockout.IPMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("auth.lockout.maxAttempts and ipMaxAttempts must be at least 1"))
+	}
+	if cfg.Auth.Lockout.BaseDelay <= 0 || cfg.Auth.Lockout.MaxDelay < cfg.Auth.Lockout.BaseDelay {
+		errs = append(errs, fmt.Errorf("auth.lockout.baseDelay must be positive and not above maxDelay"))
+	}
+	if cfg.Auth.Lockout.Window <= 0 {
+		errs = append(errs, fmt.Errorf("auth.lockout.window must be positive"))
+	}
+	if cfg.Auth.Cookie.Enabled {
+		if cfg.Auth.Cookie.Name == "" || cfg.Auth.Cookie.Name == csrfCookieName {
+			errs = append(errs, fmt.Errorf("auth.cookie.name must be set and differ from %s", csrfCookieName))
+		}
+		switch cfg.Auth.Cookie.SameSite {
+		case "strict", "lax":
+		case "none":
+			if !cfg.Auth.Cookie.Secure {
+				errs = append(errs, fmt.Errorf("auth.cookie.sameSite none requires auth.cookie.secure"))
+			}
+		default:
+			errs = append(errs, fmt.Errorf("auth.cookie.sameSite must be strict, lax or none"))
+		}
+	}
+	if _, err := url.ParseRequestURI(cfg.PublicURL); err != nil {
+		errs = append(errs, fmt.Errorf("publicURL must be an absolute URL"))
+	}
+	if cfg.Auth.EmailVerificationTTL <= 0 {
+		errs = append(errs, fmt.Errorf("auth.emailVerificationTTL must be positive"))
+	}
+	if cfg.Auth.PasswordResetTTL <= 0 {
+		errs = append(errs, fmt.Errorf("auth.passwordResetTTL must be positive"))
+	}
+	errs = append(errs, cfg.RateLimit.Default.validate("rateLimit.default"))
+	for route, rule := range cfg.RateLimit.Routes {
+		if method, path, ok := strings.Cut(route, " "); !ok || method == "" || !strings.HasPrefix(path, "/") {
+			errs = append(errs, fmt.Errorf("rateLimit.routes: %q must look like \"METHOD /path\"", route))
+		}
+		errs = append(errs, rule.validate("rateLimit.routes."+route))
+	}
+	if cfg.Cache.AccountTTL < 0 {
+		errs = append(errs, fmt.Errorf("cache.accountTTL must not be negative"))
+	}
+	if cfg.Metrics.Enabled && cfg.Metrics.Token == "" {
+		errs = append(errs, fmt.Errorf("metrics.token (METRICS_TOKEN) is required when metrics are enabled"))
+	}
+	switch cfg.Mail.Driver {
+	case "log":
+	case "file":
+		if cfg.Mail.Dir == "" {
+			errs = append(errs, fmt.Errorf("mail.dir must be set for the file driver"))
+		}
+	case "smtp":
+		if cfg.Mail.SMTPAddr == "" {
+			errs = append(errs, fmt.Errorf("mail.smtpAddr must be set for the smtp driver"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("mail.driver must be log, file or smtp"))
+	}
+	if cfg.Mail.From == "" {
+		errs = append(errs, fmt.Errorf("mail.from must be set"))
+	}
+	if cfg.Validation.MaxBodyBytes <= 0 {
+		errs = append(errs, fmt.Errorf("validation.maxBodyBytes must be positive"))
+	}
+	// Longer passwords could never be hashed
+	if cfg.Validation.Password.MinLength < 1 || cfg.Validation.Password.MinLength > maxPasswordBytes {
+		errs = append(errs, fmt.Errorf("validation.password.minLength must be between 1 and %d", maxPasswordBytes))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return nil
+}
+
+// validate checks the database settings.
+func (cfg DatabaseConfig) validate() error {
+	var errs []error
+	if cfg.DSN == "" {
+		errs = append(errs, fmt.Errorf("database.dsn must be set"))
+	}
+	if cfg.MaxOpenConns < 0 {
+		errs = append(errs, fmt.Errorf("database.maxOpenConns must not be negative"))
+	}
+	if cfg.MaxIdleConns < 0 {
+		errs = append(errs, fmt.Errorf("database.maxIdleConns must not be negative"))
+	}
+	if cfg.ConnectTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("database.connectTimeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// validate checks a single rate limit rule.
+func (rule RateLimitRule) validate(name string) error {
+	if rule.Requests < 0 {
+		return fmt.Errorf("%s.requests must not be negative", name)
+	}
+	if rule.Requests > 0 && rule.Window < time.Second {
+		return fmt.Errorf("%s.window must be at least 1s", name)
+	}
+	return nil
+}
+
+// envString sets *dst to the value of the environment variable if it is set.
+func envString(key string, dst *string) {
+	if v, ok := os.LookupEnv(key); ok {
+		*dst = v
+	}
+}
+
+// envInt sets *dst to the integer value of the environment variable if it is set.
+func envInt(key string, dst *int) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid integer %q", key, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envInt64 sets *dst to the 64-bit integer value of the environment variable if it is set.
+func envInt64(key string, dst *int64) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%s: invalid integer %q", key, v)
+	}
+	*dst = n
+	return nil
+}
+
+// envBool sets *dst to the boolean value of the environment variable if it is set.
+func envBool(key string, dst *bool) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid boolean %q", key, v)
+	}
+	*dst = b
+	return nil
+}
+
+// envDuration sets *dst to the duration value of the environment variable if it is set.
+func envDuration(key string, dst *time.Duration) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("%s: invalid duration %q", key, v)
+	}
+	*dst = d
+	return nil
+}
+
+// envSigningKeys sets *dst from a comma separated list of id=file pairs if the environment variable is set.
+func envSigningKeys(key string, dst *[]SigningKeyConfig) error {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return nil
+	}
+	var keys []SigningKeyConfig
+	for _, pair := range strings.Split(v, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		id, file, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("%s: expected id=file, got %q", key, pair)
+		}
+		keys = append(keys, SigningKeyConfig{ID: strings.TrimSpace(id), File: strings.TrimSpace(file)})
+	}
+	*dst = keys
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadMigrateConfigOnlyNeedsDatabase(t *testing.T) {
+	t.Setenv("JWT_SECRET", "")
+	t.Setenv("DATABASE_DSN", "postgres://localhost/test")
+	if _, err := LoadConfig(""); err == nil || !strings.Contains(err.Error(), "auth.jwtSecret") {
+		t.Fatalf("LoadConfig without a JWT secret: err = %v, want auth.jwtSecret error", err)
+	}
+	cfg, err := LoadMigrateConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.DSN != "postgres://localhost/test" {
+		t.Fatalf("DSN = %q, want the DATABASE_DSN value", cfg.Database.DSN)
+	}
+
+	t.Setenv("DATABASE_DSN", "")
+	if _, err := LoadMigrateConfig(""); err == nil || !strings.Contains(err.Error(), "database.dsn") {
+		t.Fatalf("LoadMigrateConfig without a DSN: err = %v, want database.dsn error", err)
+	}
+}
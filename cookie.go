@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+)
+
+const (
+	// csrfCookieName is the readable cookie carrying the CSRF token in cookie mode.
+	csrfCookieName = "csrf_token"
+	// csrfHeader is the header cookie-authenticated requests must echo the CSRF token in.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfToken derives the CSRF token bound to an access token, so no extra state has to be stored.
+func csrfToken(cfg AuthConfig, accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(cfg.JWTSecret))
+	mac.Write([]byte("csrf:" + accessToken))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// validCSRF reports whether the request echoes the CSRF token of its cookie access token.
+// Safe methods do not change state and need no CSRF token.
+func validCSRF(r *http.Request, cfg AuthConfig, accessToken string) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	}
+	got := r.Header.Get(csrfHeader)
+	return got != "" && hmac.Equal([]byte(got), []byte(csrfToken(cfg, accessToken)))
+}
+
+// cookieSameSite maps the configured SameSite value to its http constant.
+func cookieSameSite(value string) http.SameSite {
+	switch value {
+	case "lax":
+		return http.SameSiteLaxMode
+	case "none":
+		return http.SameSiteNoneMode
+	default:
+		return http.SameSiteStrictMode
+	}
+}
+
+// setAuthCookies stores the access token in an HttpOnly cookie and its CSRF token in a readable one.
+// It returns the CSRF token.
+func setAuthCookies(w http.ResponseWriter, cfg AuthConfig, accessToken string) string {
+	csrf := csrfToken(cfg, accessToken)
+	maxAge := int(cfg.AccessTokenTTL.Seconds())
+	http.SetCookie(w, &http.Cookie{
+		Name:     cfg.Cookie.Name,
+		Value:    accessToken,
+		Path:     "/",
+		Domain:   cfg.Cookie.Domain,
+		MaxAge:   maxAge,
+		Secure:   cfg.Cookie.Secure,
+		HttpOnly: true,
+		SameSite: cookieSameSite(cfg.Cookie.SameSite),
+	})
+	http.SetCookie(w, &http.Cookie{
+		Name:     csrfCookieName,
+		Value:    csrf,
+		Path:     "/",
+		Domain:   cfg.Cookie.Domain,
+		MaxAge:   maxAge,
+		Secure:   cfg.Cookie.Secure,
+		SameSite: cookieSameSite(cfg.Cookie.SameSite),
+	})
+	return csrf
+}
+
+// clearAuthCookies tells the browser to drop the cookies set by setAuthCookies.
+func clearAuthCookies(w http.ResponseWriter, cfg AuthConfig) {
+	for _, name := range []string{cfg.Cookie.Name, csrfCookieName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:     name,
+			Path:     "/",
+			Domain:   cfg.Cookie.Domain,
+			MaxAge:   -1,
+			Secure:   cfg.Cookie.Secure,
+			SameSite: cookieSameSite(cfg.Cookie.SameSite),
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCookieModeRequiresCSRFToken(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) { cfg.Auth.Cookie.Enabled = true })
+	env.createAccount("alice", "passw0rd1", roleUser)
+
+	rec := env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"})
+	expectStatus(t, rec, http.StatusOK)
+	login := decodeBody[LoginResponse](t, rec)
+	if login.Token != "" || login.CSRFToken == "" {
+		t.Fatalf("cookie mode login = %+v, want no token in the body and a CSRF token", login)
+	}
+	cookies := rec.Result().Cookies()
+
+	send := func(method, path, csrf string) int {
+		req := httptest.NewRequest(method, path, nil)
+		for _, cookie := range cookies {
+			req.AddCookie(cookie)
+		}
+		if csrf != "" {
+			req.Header.Set(csrfHeader, csrf)
+		}
+		rec := httptest.NewRecorder()
+		env.handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	if code := send("GET", "/me", ""); code != http.StatusOK {
+		t.Fatalf("GET /me with the cookie = %d, want 200", code)
+	}
+	// A cross-site <img src=/logout> must not end the session
+	for _, path := range []string{"/logout", "/1/logout"} {
+		if code := send("GET", path, ""); code != http.StatusMethodNotAllowed {
+			t.Fatalf("GET %s with the cookie = %d, want 405", path, code)
+		}
+	}
+	if code := send("GET", "/me", ""); code != http.StatusOK {
+		t.Fatalf("GET /me after the GET logouts = %d, want 200", code)
+	}
+	if code := send("POST", "/logout", ""); code != http.StatusForbidden {
+		t.Fatalf("POST /logout without CSRF token = %d, want 403", code)
+	}
+	if code := send("POST", "/logout", login.CSRFToken); code != http.StatusOK {
+		t.Fatalf("POST /logout with CSRF token = %d, want 200", code)
+	}
+}
+
+func TestListPostsByTag(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+	rec := env.do("POST", "/posts", token, PostRequest{Title: "Go", Status: postPublished, Tags: []string{"Go Lang"}})
+	expectStatus(t, rec, http.StatusOK)
+	if tags := decodeBody[Post](t, rec).Tags; len(tags) != 1 || tags[0] != "go-lang" {
+		t.Fatalf("stored tags = %v, want [go-lang]", tags)
+	}
+
+	for tag, want := range map[string]int{"Go%20Lang": 1, "go-lang": 1, "GO_LANG": 1, "rust": 0, "%21%21": 0} {
+		rec := env.do("GET", "/posts?tag="+tag, "", nil)
+		expectStatus(t, rec, http.StatusOK)
+		if got := len(decodeBody[[]*Post](t, rec)); got != want {
+			t.Errorf("tag %s: %d posts, want %d", tag, got, want)
+		}
+	}
+}
+
+func TestLegacyLogoutWithTokenHeader(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	login := env.login("alice", "passw0rd1")
+
+	req := httptest.NewRequest("GET", "/1/logout", nil)
+	req.Header.Set("token", login.Token)
+	rec := httptest.NewRecorder()
+	env.handler.ServeHTTP(rec, req)
+	expectStatus(t, rec, http.StatusOK)
+	if rec.Header().Get("Deprecation") == "" {
+		t.Fatal("legacy token header response lacks the Deprecation header")
+	}
+	expectStatus(t, env.do("GET", "/me", login.Token, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/logout", env.login("alice", "passw0rd1").Token, nil), http.StatusMethodNotAllowed)
+}
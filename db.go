@@ -1,18 +1,37 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
+	"strings"
 )
 
 // Storage defines the methods for interacting with the database.
 type Storage interface {
 	CreateAccount(*Account) error
-	GetAllAccounts() ([]*Account, error)
+	ListAccounts(AccountQuery) (*AccountPage, error)
 	GetAccountByID(int) (*Account, error)
+	GetAccountByUsername(string) (*Account, error)
+	GetAccountByEmail(string) (*Account, error)
 	DeleteAccount(int) error
+	Close() error
+	Ping(context.Context) error
 	UpdateAccount(*Account) error
+	BumpTokenVersion(int) (int, error)
+	SetPassword(int, string) (int, error)
+	GetRole(int) (*Role, error)
+	CreatePost(*Post) error
+	GetPostByID(int) (*Post, error)
+	ListPosts(PostQuery) ([]*Post, error)
+	UpdatePost(*Post) error
+	DeletePost(int) error
+	SearchPosts(string, int) ([]*SearchResult, error)
+	ListTags() ([]*TagCount, error)
+	CreateCategory(*Category) error
+	ListCategories() ([]*Category, error)
 }
 
 // PostgresDB represents a connection to a PostgreSQL database.
@@ -21,130 +40,502 @@ type PostgresDB struct {
 }
 
 // NewPostgresDB creates a new PostgresDB instance.
-func NewPostgresDB() (*PostgresDB, error) {
-	connStr := "user=postgres dbname=postgres sslmode=disable"
-	db, err := sql.Open("postgres", connStr)
+func NewPostgresDB(cfg DatabaseConfig) (*PostgresDB, error) {
+	db, err := sql.Open("postgres", cfg.DSN)
 	if err != nil {
 		return nil, err
 	}
-	if err := db.Ping(); err != nil {
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	if err := retryWithBackoff("PostgreSQL", cfg.ConnectTimeout, db.PingContext); err != nil {
+		db.Close()
 		return nil, err
 	}
 	return &PostgresDB{db: db}, nil
 }
 
-// InitDB initializes the database schema.
+// Ping checks that the database is reachable.
+func (s *PostgresDB) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// Close closes the connection pool once the queries in progress have finished.
+func (s *PostgresDB) Close() error {
+	return s.db.Close()
+}
+
+// InitDB initializes the database schema by applying pending migrations.
 func (s *PostgresDB) InitDB() error {
-	if err := s.CreateRoleTable(); err != nil {
+	return s.MigrateUp(context.Background())
+}
+
+// accountColumns lists the account columns in the order scanIntoAccount expects.
+const accountColumns = `id, firstName, lastName, email, username, hash, country, roleID, createdAt, emailVerified, tokenVersion`
+
+// CreateAccount inserts a new account into the database.
+func (s *PostgresDB) CreateAccount(account *Account) error {
+	query := `INSERT INTO account (firstName, lastName, email, username, hash, country, roleID, createdAt, emailVerified)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id`
+	err := s.db.QueryRow(query, account.FirstName, account.LastName, account.Email, account.Username,
+		account.EncryptedPassword, account.Country, account.RoleID, account.CreatedAt, account.EmailVerified).Scan(&account.ID)
+	return accountConflict(err, account)
+}
+
+// accountConflict turns a violation of the unique username or e-mail index into a conflict error.
+func accountConflict(err error, account *Account) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23505" {
 		return err
 	}
-	if err := s.CreateAccountTable(); err != nil {
+	switch pqErr.Constraint {
+	case "account_username_key":
+		return conflictField("username", "%s is already taken", account.Username)
+	case "account_email_key":
+		return conflictField("email", "%s is already registered", account.Email)
+	}
+	return err
+}
+
+// ListAccounts retrieves one page of accounts matching the query using keyset pagination.
+func (s *PostgresDB) ListAccounts(q AccountQuery) (*AccountPage, error) {
+	column := accountSortColumns[q.Sort]
+	if column == "" {
+		return nil, invalidField("sort", "cannot sort by %s", q.Sort)
+	}
+	var where []string
+	var args []interface{}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if q.Country != "" {
+		where = append(where, "country = "+arg(q.Country))
+	}
+	if q.RoleID != 0 {
+		where = append(where, "roleID = "+arg(q.RoleID))
+	}
+	if !q.CreatedAfter.IsZero() {
+		where = append(where, "createdAt > "+arg(q.CreatedAfter))
+	}
+	direction, cmp := "ASC", ">"
+	if q.Desc {
+		direction, cmp = "DESC", "<"
+	}
+	if q.After != nil {
+		if column == "id" {
+			where = append(where, "id "+cmp+" "+arg(q.After.ID))
+		} else {
+			value := arg(accountSortValue(q.Sort, q.After))
+			where = append(where, fmt.Sprintf("(%s, id) %s (%s, %s)", column, cmp, value, arg(q.After.ID)))
+		}
+	}
+
+	query := `SELECT ` + accountColumns + ` FROM account`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	if column != "id" {
+		query += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+	} else {
+		query += " ORDER BY id " + direction
+	}
+	query += " LIMIT " + arg(q.Limit+1)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	accounts := []*Account{}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return newAccountPage(q, accounts), nil
+}
+
+// queryAccount returns the account matching the where clause, or nil if there is none.
+// The rows are always closed so the connection goes back to the pool.
+func (s *PostgresDB) queryAccount(where string, args ...interface{}) (*Account, error) {
+	rows, err := s.db.Query("select "+accountColumns+" from account "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+	return scanIntoAccount(rows)
+}
+
+// GetAccountByID retrieves an account by its ID from the database.
+func (s *PostgresDB) GetAccountByID(id int) (*Account, error) {
+	account, err := s.queryAccount("where id = $1", id)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return nil, notFound("account %d not found", id)
+}
+
+// GetAccountByUsername retrieves an account by its username from the database.
+func (s *PostgresDB) GetAccountByUsername(username string) (*Account, error) {
+	account, err := s.queryAccount("where lower(username) = lower($1)", username)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return nil, notFound("account %s not found", username)
+}
+
+// GetAccountByEmail retrieves an account by its e-mail address from the database.
+func (s *PostgresDB) GetAccountByEmail(email string) (*Account, error) {
+	account, err := s.queryAccount("where lower(email) = lower($1) and email <> ''", email)
+	if err != nil || account != nil {
+		return account, err
+	}
+	return nil, notFound("account with e-mail %s not found", email)
+}
+
+// UpdateAccount updates the editable fields of an existing account.
+// The password hash and token version are left alone, see SetPassword and BumpTokenVersion.
+func (s *PostgresDB) UpdateAccount(account *Account) error {
+	query := `UPDATE account
+		SET firstName = $1, lastName = $2, email = $3, country = $4, emailVerified = $5
+		WHERE id = $6`
+	res, err := s.db.Exec(query, account.FirstName, account.LastName, account.Email,
+		account.Country, account.EmailVerified, account.ID)
+	if err != nil {
+		return accountConflict(err, account)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
 		return err
 	}
+	if n == 0 {
+		return notFound("account %d not found", account.ID)
+	}
 	return nil
 }
 
-// CreateAccountTable creates the account table if it does not exist.
-func (s *PostgresDB) CreateAccountTable() error {
-	query := `CREATE TABLE IF NOT EXISTS account (
-		id SERIAL PRIMARY KEY,
-		firstName VARCHAR(255),
-		lastName VARCHAR(255),
-		email VARCHAR(255),
-		username VARCHAR(255),
-		hash VARCHAR(255),
-		country VARCHAR(255),
-		roleID INT REFERENCES role(id),
-		createdAt TIMESTAMP
-	)`
-	_, err := s.db.Exec(query)
+// BumpTokenVersion increments the token version of the account in place and returns the new one.
+// Every access token issued before carries an older version and is refused from then on.
+func (s *PostgresDB) BumpTokenVersion(id int) (int, error) {
+	var version int
+	err := s.db.QueryRow(`UPDATE account SET tokenVersion = tokenVersion + 1 WHERE id = $1 RETURNING tokenVersion`, id).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, notFound("account %d not found", id)
+	}
+	return version, err
+}
+
+// SetPassword stores a new password hash and bumps the token version in the same statement,
+// so no token issued before the change outlives it. It returns the new token version.
+func (s *PostgresDB) SetPassword(id int, hash string) (int, error) {
+	var version int
+	err := s.db.QueryRow(`UPDATE account SET hash = $2, tokenVersion = tokenVersion + 1 WHERE id = $1 RETURNING tokenVersion`, id, hash).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, notFound("account %d not found", id)
+	}
+	return version, err
+}
+
+// GetRole retrieves a role and its permissions by the role ID.
+func (s *PostgresDB) GetRole(id int) (*Role, error) {
+	role := &Role{Permissions: []string{}}
+	err := s.db.QueryRow("select id, name from role where id = $1", id).Scan(&role.ID, &role.Name)
+	if err == sql.ErrNoRows {
+		return nil, notFound("role %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT p.name FROM permission p
+		JOIN role_permission rp ON rp.permissionID = p.id
+		WHERE rp.roleID = $1`
+	rows, err := s.db.Query(query, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		role.Permissions = append(role.Permissions, name)
+	}
+	return role, rows.Err()
+}
+
+// DeleteAccount deletes an account from the database by its ID.
+func (s *PostgresDB) DeleteAccount(id int) error {
+	query := `DELETE FROM account WHERE id = $1`
+	_, err := s.db.Exec(query, id)
 	return err
 }
 
-// CreateRoleTable creates the role table if it does not exist.
-func (s *PostgresDB) CreateRoleTable() error {
-	query := `CREATE TABLE IF NOT EXISTS role (
-		id SERIAL PRIMARY KEY,
-		name VARCHAR(50) UNIQUE
-	)`
-	_, err := s.db.Exec(query)
+// postColumns lists the post columns, tags and category slugs in the order scanIntoPost expects.
+const postColumns = `post.id, post.authorID, post.title, post.slug, post.body, post.status,
+		post.createdAt, post.updatedAt,
+		ARRAY(SELECT t.name FROM post_tag pt JOIN tag t ON t.id = pt.tagID
+			WHERE pt.postID = post.id ORDER BY t.name),
+		ARRAY(SELECT c.slug FROM post_category pc JOIN category c ON c.id = pc.categoryID
+			WHERE pc.postID = post.id ORDER BY c.slug)`
+
+// postSelect selects every post with the columns scanIntoPost expects.
+const postSelect = `SELECT ` + postColumns + ` FROM post`
+
+// CreatePost inserts a new post together with its tags and categories.
+func (s *PostgresDB) CreatePost(post *Post) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
+	defer tx.Rollback()
 
-	// Check if the table is empty
-	var rowCount int
-	err = s.db.QueryRow("SELECT COUNT(*) FROM role").Scan(&rowCount)
+	query := `INSERT INTO post (authorID, title, slug, body, status, createdAt, updatedAt)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id`
+	err = tx.QueryRow(query, post.AuthorID, post.Title, post.Slug, post.Body,
+		post.Status, post.CreatedAt, post.UpdatedAt).Scan(&post.ID)
+	if isUniqueViolation(err) {
+		return conflict("slug %q is already in use", post.Slug)
+	}
 	if err != nil {
 		return err
 	}
-	if rowCount == 0 {
-		// Insert default roles
-		query := "INSERT INTO role (name) VALUES ('admin'), ('user')"
-		_, err := s.db.Exec(query)
-		if err != nil {
+	if err := writePostTerms(tx, post); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// writePostTerms replaces the tags and categories linked to the post.
+// Unknown tags are created, unknown categories are an error.
+func writePostTerms(tx *sql.Tx, post *Post) error {
+	if _, err := tx.Exec(`DELETE FROM post_tag WHERE postID = $1`, post.ID); err != nil {
+		return err
+	}
+	for _, tag := range post.Tags {
+		var tagID int
+		query := `INSERT INTO tag (name) VALUES ($1)
+			ON CONFLICT (name) DO UPDATE SET name = EXCLUDED.name
+			RETURNING id`
+		if err := tx.QueryRow(query, tag).Scan(&tagID); err != nil {
 			return err
 		}
+		if _, err := tx.Exec(`INSERT INTO post_tag (postID, tagID) VALUES ($1, $2)`, post.ID, tagID); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM post_category WHERE postID = $1`, post.ID); err != nil {
+		return err
+	}
+	if len(post.Categories) == 0 {
+		return nil
+	}
+	query := `INSERT INTO post_category (postID, categoryID)
+		SELECT $1, id FROM category WHERE slug = ANY($2)`
+	res, err := tx.Exec(query, post.ID, pq.Array(post.Categories))
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if int(n) != len(post.Categories) {
+		return invalidField("categories", "unknown category in %v", post.Categories)
 	}
 	return nil
 }
 
-// CreateAccount inserts a new account into the database.
-func (s *PostgresDB) CreateAccount(account *Account) error {
-	query := `INSERT INTO account (firstName, lastName, email, username, hash, country, roleID, createdAt)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := s.db.Exec(query, account.FirstName, account.LastName, account.Email,
-		account.Username, account.EncryptedPassword, account.Country, account.RoleID, account.CreatedAt)
-	return err
+// GetPostByID retrieves a post by its ID from the database.
+func (s *PostgresDB) GetPostByID(id int) (*Post, error) {
+	rows, err := s.db.Query(postSelect+" WHERE post.id = $1", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if rows.Next() {
+		return scanIntoPost(rows)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return nil, notFound("post %d not found", id)
 }
 
-// GetAllAccounts retrieves all accounts from the database.
-func (s *PostgresDB) GetAllAccounts() ([]*Account, error) {
-	query := `SELECT * FROM account`
-	rows, err := s.db.Query(query)
+// ListPosts retrieves the posts matching the query, newest first.
+// Filtering by a category also matches posts in its subcategories.
+func (s *PostgresDB) ListPosts(q PostQuery) ([]*Post, error) {
+	query := `WITH RECURSIVE subcategory AS (
+			SELECT id FROM category WHERE slug = $4::text
+			UNION
+			SELECT c.id FROM category c JOIN subcategory sc ON c.parentID = sc.id
+		)
+		` + postSelect + `
+		WHERE ($1::text = '' OR post.status = $1::text)
+			AND ($2::int = 0 OR post.authorID = $2::int)
+			AND ($3::text = '' OR EXISTS (
+				SELECT 1 FROM post_tag pt JOIN tag t ON t.id = pt.tagID
+				WHERE pt.postID = post.id AND t.name = $3::text))
+			AND ($4::text = '' OR EXISTS (
+				SELECT 1 FROM post_category pc
+				WHERE pc.postID = post.id AND pc.categoryID IN (SELECT id FROM subcategory)))
+		ORDER BY post.createdAt DESC, post.id DESC`
+	rows, err := s.db.Query(query, q.Status, q.AuthorID, q.Tag, q.Category)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var accounts []*Account
+	posts := []*Post{}
 	for rows.Next() {
-		account, err := scanIntoAccount(rows)
+		post, err := scanIntoPost(rows)
 		if err != nil {
 			return nil, err
 		}
-		accounts = append(accounts, account)
+		posts = append(posts, post)
 	}
-	return accounts, nil
+	return posts, rows.Err()
 }
 
-// GetAccountByID retrieves an account by its ID from the database.
-func (s *PostgresDB) GetAccountByID(id int) (*Account, error) {
-	rows, err := s.db.Query("select * from account where id = $1", id)
+// UpdatePost updates the editable fields, tags and categories of an existing post.
+func (s *PostgresDB) UpdatePost(post *Post) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE post
+		SET title = $1, slug = $2, body = $3, status = $4, updatedAt = $5
+		WHERE id = $6`
+	res, err := tx.Exec(query, post.Title, post.Slug, post.Body, post.Status, post.UpdatedAt, post.ID)
+	if isUniqueViolation(err) {
+		return conflict("slug %q is already in use", post.Slug)
+	}
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound("post %d not found", post.ID)
+	}
+	if err := writePostTerms(tx, post); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeletePost deletes a post from the database by its ID.
+func (s *PostgresDB) DeletePost(id int) error {
+	_, err := s.db.Exec(`DELETE FROM post WHERE id = $1`, id)
+	return err
+}
+
+// SearchPosts runs a full-text search over the title and body of published posts.
+// Results are ordered by ts_rank and carry a highlighted snippet of the body.
+func (s *PostgresDB) SearchPosts(text string, limit int) ([]*SearchResult, error) {
+	query := `SELECT ` + postColumns + `,
+			ts_rank(post.search, q.query) AS rank,
+			ts_headline('english', post.body, q.query, $3)
+		FROM post, websearch_to_tsquery('english', $1) AS q(query)
+		WHERE post.status = 'published' AND post.search @@ q.query
+		ORDER BY rank DESC, post.id DESC
+		LIMIT $2`
+	options := fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxFragments=2, MaxWords=30, MinWords=10`, snippetStart, snippetStop)
+	rows, err := s.db.Query(query, text, limit, options)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	results := []*SearchResult{}
 	for rows.Next() {
-		return scanIntoAccount(rows)
+		result, err := scanIntoSearchResult(rows)
+		if err != nil {
+			return nil, err
+		}
+		result.Snippet = markSnippet(result.Snippet)
+		results = append(results, result)
 	}
-	return nil, fmt.Errorf("account %d not found", id)
+	return results, rows.Err()
 }
 
-// GetAccountByUsername retrieves an account by its username from the database.
-func (s *PostgresDB) GetAccountByUsername(username string) (*Account, error) {
-	rows, err := s.db.Query("select * from account where username = $1", username)
+// ListTags retrieves every tag with the number of published posts carrying it.
+func (s *PostgresDB) ListTags() ([]*TagCount, error) {
+	query := `SELECT t.name, COUNT(p.id)
+		FROM tag t
+		LEFT JOIN post_tag pt ON pt.tagID = t.id
+		LEFT JOIN post p ON p.id = pt.postID AND p.status = 'published'
+		GROUP BY t.name
+		ORDER BY t.name`
+	rows, err := s.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	tags := []*TagCount{}
 	for rows.Next() {
-		return scanIntoAccount(rows)
+		tag := new(TagCount)
+		if err := rows.Scan(&tag.Name, &tag.PostCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
 	}
-	return nil, fmt.Errorf("account %s not found", username)
+	return tags, rows.Err()
 }
 
-// DeleteAccount deletes an account from the database by its ID.
-func (s *PostgresDB) DeleteAccount(id int) error {
-	query := `DELETE FROM account WHERE id = $1`
-	_, err := s.db.Exec(query, id)
+// CreateCategory inserts a new category into the database.
+func (s *PostgresDB) CreateCategory(category *Category) error {
+	query := `INSERT INTO category (name, slug, parentID) VALUES ($1, $2, $3) RETURNING id`
+	err := s.db.QueryRow(query, category.Name, category.Slug, category.ParentID).Scan(&category.ID)
+	if isUniqueViolation(err) {
+		return conflict("category %q already exists", category.Slug)
+	}
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" {
+		return invalidField("parentId", "parent category %d not found", *category.ParentID)
+	}
 	return err
 }
+
+// ListCategories retrieves every category ordered by name.
+func (s *PostgresDB) ListCategories() ([]*Category, error) {
+	rows, err := s.db.Query(`SELECT id, name, slug, parentID FROM category ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := []*Category{}
+	for rows.Next() {
+		category := new(Category)
+		if err := rows.Scan(&category.ID, &category.Name, &category.Slug, &category.ParentID); err != nil {
+			return nil, err
+		}
+		categories = append(categories, category)
+	}
+	return categories, rows.Err()
+}
+
+// isUniqueViolation reports whether err is a PostgreSQL unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
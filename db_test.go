@@ -0,0 +1,37 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestAccountConflict(t *testing.T) {
+	account := &Account{Username: "alice", Email: "alice@example.com"}
+	tests := []struct {
+		name  string
+		err   error
+		field string
+	}{
+		{"username", &pq.Error{Code: "23505", Constraint: "account_username_key"}, "username"},
+		{"email", &pq.Error{Code: "23505", Constraint: "account_email_key"}, "email"},
+		{"other constraint", &pq.Error{Code: "23505", Constraint: "something_else"}, ""},
+		{"other error", &pq.Error{Code: "23503", Constraint: "account_username_key"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := accountConflict(tt.err, account)
+			var domainErr *DomainError
+			if tt.field == "" {
+				if err != tt.err {
+					t.Fatalf("accountConflict = %v, want the original error", err)
+				}
+				return
+			}
+			if !errors.As(err, &domainErr) || domainErr.Kind != KindConflict || domainErr.Fields[0].Field != tt.field {
+				t.Fatalf("accountConflict = %v, want a conflict on %s", err, tt.field)
+			}
+		})
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorKind classifies a DomainError and decides its HTTP status.
+type ErrorKind int
+
+const (
+	KindInternal ErrorKind = iota
+	KindValidation
+	KindUnauthorized
+	KindForbidden
+	KindNotFound
+	KindMethodNotAllowed
+	KindConflict
+	KindTooManyRequests
+)
+
+// status returns the HTTP status code of the error kind.
+func (k ErrorKind) status() int {
+	switch k {
+	case KindValidation:
+		return http.StatusBadRequest
+	case KindUnauthorized:
+		return http.StatusUnauthorized
+	case KindForbidden:
+		return http.StatusForbidden
+	case KindNotFound:
+		return http.StatusNotFound
+	case KindMethodNotAllowed:
+		return http.StatusMethodNotAllowed
+	case KindConflict:
+		return http.StatusConflict
+	case KindTooManyRequests:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// DomainError is an error whose message is safe to show to clients.
+// Errors of any other type are treated as internal and only logged.
+type DomainError struct {
+	Kind    ErrorKind
+	Message string
+	Fields  []FieldError
+	Err     error // underlying cause, never sent to the client
+
+	RetryAfter time.Duration // sent as the Retry-After header when set
+}
+
+func (e *DomainError) Error() string {
+	if e.Err != nil {
+		return e.Message + ": " + e.Err.Error()
+	}
+	return e.Message
+}
+
+func (e *DomainError) Unwrap() error {
+	return e.Err
+}
+
+// notFound returns a KindNotFound error.
+func notFound(format string, args ...interface{}) error {
+	return &DomainError{Kind: KindNotFound, Message: fmt.Sprintf(format, args...)}
+}
+
+// conflict returns a KindConflict error.
+func conflict(format string, args ...interface{}) error {
+	return &DomainError{Kind: KindConflict, Message: fmt.Sprintf(format, args...)}
+}
+
+// conflictField returns a KindConflict error naming the request field that clashes.
+func conflictField(field, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	return &DomainError{
+		Kind:    KindConflict,
+		Message: field + ": " + message,
+		Fields:  []FieldError{{Field: field, Message: message}},
+	}
+}
+
+// invalid returns a KindValidation error that is not tied to a single field.
+func invalid(format string, args ...interface{}) error {
+	return &DomainError{Kind: KindValidation, Message: fmt.Sprintf(format, args...)}
+}
+
+// invalidField returns a KindValidation error for the named request field.
+func invalidField(field, format string, args ...interface{}) error {
+	message := fmt.Sprintf(format, args...)
+	return &DomainError{
+		Kind:    KindValidation,
+		Message: field + ": " + message,
+		Fields:  []FieldError{{Field: field, Message: message}},
+	}
+}
+
+// unauthorized returns a KindUnauthorized error.
+func unauthorized(message string) error {
+	return &DomainError{Kind: KindUnauthorized, Message: message}
+}
+
+// forbidden returns a KindForbidden error.
+func forbidden(message string) error {
+	return &DomainError{Kind: KindForbidden, Message: message}
+}
+
+// methodNotAllowed returns a KindMethodNotAllowed error for the request method.
+func methodNotAllowed(method string) error {
+	return &DomainError{Kind: KindMethodNotAllowed, Message: fmt.Sprintf("method not allowed %s", method)}
+}
+
+// tooManyRequests returns a KindTooManyRequests error telling the client when to retry.
+func tooManyRequests(retryAfter time.Duration, message string) error {
+	return &DomainError{Kind: KindTooManyRequests, Message: message, RetryAfter: retryAfter}
+}
+
+// internal wraps err in a KindInternal error with a generic message.
+func internal(err error) error {
+	return &DomainError{Kind: KindInternal, Message: "internal server error", Err: err}
+}
+
+// Problem represents an RFC 7807 problem details response.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Instance  string       `json:"instance,omitempty"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// writeError sends err as a problem+json response.
+// Anything but a client-facing DomainError is logged and reported as a bare 500.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	requestID := requestIDFromContext(r.Context())
+	var domainErr *DomainError
+	if !errors.As(err, &domainErr) {
+		domainErr = internal(err).(*DomainError)
+	}
+	status := domainErr.Kind.status()
+	if status == http.StatusInternalServerError {
+		log.Printf("request %s %s %s: %v", requestID, r.Method, r.URL.Path, err)
+	}
+	problem := Problem{
+		Type:      "about:blank",
+		Title:     http.StatusText(status),
+		Status:    status,
+		Detail:    domainErr.Message,
+		Instance:  r.URL.Path,
+		RequestID: requestID,
+		Errors:    domainErr.Fields,
+	}
+	if domainErr.RetryAfter > 0 {
+		// Round up so clients never retry a moment too early
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(domainErr.RetryAfter.Seconds()))))
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem)
+}
+
+// requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+// requestIDFromContext returns the request ID set by withRequestID, if any.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// withRequestID is a middleware that tags each request with an ID, taken from the
+// X-Request-ID header when the client sends one, and echoes it in the response.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id, _ = randomToken(12)
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
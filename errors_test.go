@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// flakyStore is a MemoryDB whose account lookups by ID fail while down is set.
+type flakyStore struct {
+	*MemoryDB
+	down atomic.Bool
+}
+
+func (s *flakyStore) GetAccountByID(id int) (*Account, error) {
+	if s.down.Load() {
+		return nil, errors.New("database is unreachable")
+	}
+	return s.MemoryDB.GetAccountByID(id)
+}
+
+func TestCallerLookupFailureIsNotUnauthorized(t *testing.T) {
+	store := &flakyStore{MemoryDB: NewMemoryDB()}
+	env := newTestEnvWithStore(t, store)
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+
+	store.down.Store(true)
+	rec := env.do("GET", "/me", token, nil)
+	expectStatus(t, rec, http.StatusInternalServerError)
+	if problem := decodeBody[Problem](t, rec); problem.Detail == "database is unreachable" {
+		t.Fatalf("internal error reached the client: %+v", problem)
+	}
+
+	store.down.Store(false)
+	expectStatus(t, env.do("GET", "/me", token, nil), http.StatusOK)
+
+	// A token whose account was deleted is no longer valid
+	if err := env.store.DeleteAccount(account.ID); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, env.do("GET", "/account/"+strconv.Itoa(account.ID), token, nil), http.StatusUnauthorized)
+}
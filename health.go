@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// readinessTimeout bounds each dependency check of /readyz.
+const readinessTimeout = 2 * time.Second
+
+// DependencyStatus is the outcome of checking one dependency.
+type DependencyStatus struct {
+	Status    string  `json:"status"` // up or down
+	LatencyMs float64 `json:"latencyMs"`
+}
+
+// ReadinessResponse reports whether the service can take traffic, per dependency.
+type ReadinessResponse struct {
+	Status       string                      `json:"status"` // ready or unavailable
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// checkDependency runs a ping with a timeout and reports its outcome and latency.
+// Why a dependency is down is only logged, since it can name internal hosts.
+func checkDependency(ctx context.Context, name string, ping func(context.Context) error) DependencyStatus {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	start := time.Now()
+	err := ping(ctx)
+	status := DependencyStatus{Status: "up", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+	if err != nil {
+		status.Status = "down"
+		log.Printf("readiness: %s is down: %v", name, err)
+	}
+	return status
+}
+
+// retryWithBackoff calls connect until it succeeds or timeout has passed, doubling the pause
+// between attempts from 500ms up to 10s. It returns the last error when it gives up.
+func retryWithBackoff(name string, timeout time.Duration, connect func(context.Context) error) error {
+	deadline := time.Now().Add(timeout)
+	backoff := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		err := connect(ctx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(backoff).After(deadline) {
+			return fmt.Errorf("connecting to %s: giving up after %d attempts: %w", name, attempt, err)
+		}
+		log.Printf("connecting to %s failed (attempt %d), retrying in %s: %v", name, attempt, backoff, err)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > 10*time.Second {
+			backoff = 10 * time.Second
+		}
+	}
+}
+
+// handleHealthz handles the liveness probe.
+// @Summary Liveness probe
+// @Description Answers 200 while the process is up. It does not check any dependency.
+// @Tags health
+// @Produce json
+// @Success 200 {object} map[string]string
+// @Router /healthz [get]
+func (s *APIServer) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	return writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleReadyz handles the readiness probe.
+// @Summary Readiness probe
+// @Description Pings PostgreSQL and Redis and reports each with its latency. Answers 503 when one is down.
+// @Tags health
+// @Produce json
+// @Success 200 {object} ReadinessResponse
+// @Failure 503 {object} ReadinessResponse
+// @Router /readyz [get]
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	checks := map[string]func(context.Context) error{
+		"database": s.dbStore.Ping,
+		"redis": func(ctx context.Context) error {
+			return s.redisClient.Ping(ctx).Err()
+		},
+	}
+	resp := &ReadinessResponse{Status: "ready", Dependencies: make(map[string]DependencyStatus)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, ping := range checks {
+		wg.Add(1)
+		go func(name string, ping func(context.Context) error) {
+			defer wg.Done()
+			status := checkDependency(r.Context(), name, ping)
+			mu.Lock()
+			resp.Dependencies[name] = status
+			mu.Unlock()
+		}(name, ping)
+	}
+	wg.Wait()
+	code := http.StatusOK
+	for _, status := range resp.Dependencies {
+		if status.Status != "up" {
+			resp.Status = "unavailable"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	return writeJSON(w, code, resp)
+}
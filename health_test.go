@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadyz(t *testing.T) {
+	env := newTestEnv(t)
+	expectStatus(t, env.do("GET", "/healthz", "", nil), http.StatusOK)
+
+	rec := env.do("GET", "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if resp := decodeBody[ReadinessResponse](t, rec); resp.Status != "ready" || resp.Dependencies["redis"].Status != "up" {
+		t.Fatalf("readiness = %+v", resp)
+	}
+
+	addr := env.redis.Addr()
+	env.redis.Close()
+	rec = env.do("GET", "/readyz", "", nil)
+	expectStatus(t, rec, http.StatusServiceUnavailable)
+	resp := decodeBody[ReadinessResponse](t, rec)
+	if resp.Status != "unavailable" || resp.Dependencies["redis"].Status != "down" || resp.Dependencies["database"].Status != "up" {
+		t.Fatalf("readiness = %+v", resp)
+	}
+	if body := rec.Body.String(); strings.Contains(body, addr) || strings.Contains(body, "refused") {
+		t.Fatalf("readiness leaks the failure: %s", body)
+	}
+}
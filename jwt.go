@@ -3,41 +3,93 @@ package main
 import (
 	"fmt"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 )
 
 // generateJWT generates a JWT token for the given account.
-func generateJWT(account *Account) (string, error) {
+// It is signed with the active asymmetric key when keys are configured and with HS256 otherwise.
+func generateJWT(account *Account, cfg AuthConfig) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
 	claims := jwt.MapClaims{
-		"exp":      time.Now().Add(1 * time.Minute).Unix(),
+		"sub":      strconv.Itoa(account.ID),
+		"jti":      jti,
+		"iat":      now.Unix(),
+		"exp":      now.Add(cfg.AccessTokenTTL).Unix(),
 		"username": account.Username,
 		"role":     account.RoleID,
+		"ver":      account.TokenVersion,
+	}
+	if cfg.keys != nil {
+		token := jwt.NewWithClaims(cfg.keys.active.method, claims)
+		token.Header["kid"] = cfg.keys.active.id
+		return token.SignedString(cfg.keys.active.private)
+	}
+	if cfg.JWTSecret == "" {
+		return "", fmt.Errorf("refusing to sign a token with an empty secret")
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	secretKey := os.Getenv("bank_secret")
-	return token.SignedString([]byte(secretKey))
+	return token.SignedString([]byte(cfg.JWTSecret))
+}
+
+// tokenFromRequest returns the access token sent with the request and whether it came from the cookie.
+// Authorization: Bearer takes precedence over the deprecated token header, which takes precedence over the cookie.
+func tokenFromRequest(r *http.Request, cfg AuthConfig) (string, bool) {
+	if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token), false
+	}
+	if cfg.LegacyTokenHeader {
+		if token := r.Header.Get("token"); token != "" {
+			return token, false
+		}
+	}
+	if cfg.Cookie.Enabled {
+		if cookie, err := r.Cookie(cfg.Cookie.Name); err == nil {
+			return cookie.Value, true
+		}
+	}
+	return "", false
 }
 
-// permissionDenied sends a permission denied response with the given message.
-func permissionDenied(w http.ResponseWriter, message string) {
-	writeJSON(w, http.StatusUnauthorized, message)
+// deprecateTokenHeader is a middleware that flags responses to requests still using the legacy token header.
+func deprecateTokenHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("token") != "" && r.Header.Get("Authorization") == "" {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Add("Warning", `299 - "the token header is deprecated, send Authorization: Bearer instead"`)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // validateToken validates the JWT token from the request header.
-func validateToken(tokenFromHeader string) (*jwt.Token, error) {
-	secretKey := []byte(os.Getenv("bank_secret"))
+// Only the algorithms of the configured mode are accepted, so an HS256 token can never be checked against a public key.
+func validateToken(tokenFromHeader string, cfg AuthConfig) (*jwt.Token, error) {
+	if cfg.keys != nil {
+		checkedToken, err := jwt.Parse(tokenFromHeader, cfg.keys.verificationKey,
+			jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}))
+		if err != nil {
+			return nil, unauthorized("your Token has been expired")
+		}
+		return checkedToken, nil
+	}
+	secretKey := []byte(cfg.JWTSecret)
 	checkedToken, err := jwt.Parse(tokenFromHeader, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || len(secretKey) == 0 {
 			return nil, fmt.Errorf("There was an error in parsing token.")
 		}
 		return secretKey, nil
-	})
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
 
 	if err != nil {
-		return nil, fmt.Errorf("your Token has been expired")
+		return nil, unauthorized("your Token has been expired")
 	}
 	return checkedToken, nil
 }
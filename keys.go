@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+)
+
+// signingKey is an asymmetric key tokens are signed or verified with.
+type signingKey struct {
+	id      string
+	method  jwt.SigningMethod
+	private crypto.PrivateKey // nil for keys that are only kept to verify older tokens
+	public  crypto.PublicKey
+}
+
+// keySet holds the asymmetric signing keys. New tokens are signed with the active key,
+// tokens signed by any key of the set are accepted until that key is removed.
+type keySet struct {
+	active *signingKey
+	keys   map[string]*signingKey
+}
+
+// JWK is a public key in JSON Web Key format.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// JWKS is the document served at /.well-known/jwks.json.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// loadKeySet reads the configured PEM files. It returns nil when no keys are configured,
+// in which case tokens are signed with HS256 and the JWT secret.
+func loadKeySet(cfg AuthConfig) (*keySet, error) {
+	if len(cfg.SigningKeys) == 0 {
+		return nil, nil
+	}
+	set := &keySet{keys: make(map[string]*signingKey)}
+	for _, kc := range cfg.SigningKeys {
+		data, err := os.ReadFile(kc.File)
+		if err != nil {
+			return nil, fmt.Errorf("reading signing key %s: %w", kc.ID, err)
+		}
+		key, err := parseSigningKey(kc.ID, data)
+		if err != nil {
+			return nil, err
+		}
+		set.keys[kc.ID] = key
+	}
+	activeID := cfg.ActiveKey
+	if activeID == "" {
+		activeID = cfg.SigningKeys[0].ID
+	}
+	set.active = set.keys[activeID]
+	if set.active == nil || set.active.private == nil {
+		return nil, fmt.Errorf("active signing key %s must be a private key", activeID)
+	}
+	return set, nil
+}
+
+// parseSigningKey parses an RSA or Ed25519 key, private or public, from PEM.
+func parseSigningKey(id string, data []byte) (*signingKey, error) {
+	if key, err := jwt.ParseRSAPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, private: key, public: &key.PublicKey}, nil
+	}
+	if key, err := jwt.ParseEdPrivateKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, private: key, public: key.(ed25519.PrivateKey).Public()}, nil
+	}
+	if key, err := jwt.ParseRSAPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodRS256, public: key}, nil
+	}
+	if key, err := jwt.ParseEdPublicKeyFromPEM(data); err == nil {
+		return &signingKey{id: id, method: jwt.SigningMethodEdDSA, public: key}, nil
+	}
+	return nil, fmt.Errorf("signing key %s is not an RSA or Ed25519 PEM key", id)
+}
+
+// verificationKey returns the public key a token claims to be signed with.
+// The key must exist and its algorithm must match the token's.
+func (set *keySet) verificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	key, ok := set.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("signing key %s does not use %s", kid, token.Method.Alg())
+	}
+	return key.public, nil
+}
+
+// jwks returns the public keys of the set in JSON Web Key format.
+func (set *keySet) jwks() *JWKS {
+	doc := &JWKS{Keys: []JWK{}}
+	if set == nil {
+		return doc
+	}
+	for _, key := range set.keys {
+		jwk := JWK{Kid: key.id, Use: "sig", Alg: key.method.Alg()}
+		switch public := key.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		}
+		doc.Keys = append(doc.Keys, jwk)
+	}
+	sort.Slice(doc.Keys, func(i, j int) bool { return doc.Keys[i].Kid < doc.Keys[j].Kid })
+	return doc
+}
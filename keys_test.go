@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// writePEM stores a private key as PKCS #8 or a public key as PKIX in dir and returns the file name.
+func writePEM(t *testing.T, dir, name string, key interface{}) string {
+	t.Helper()
+	var block *pem.Block
+	if !isPrivateKey(key) {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PUBLIC KEY", Bytes: der}
+	} else {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	file := filepath.Join(dir, name+".pem")
+	if err := os.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// isPrivateKey reports whether key is one of the private key types used here.
+func isPrivateKey(key interface{}) bool {
+	switch key.(type) {
+	case *rsa.PrivateKey, ed25519.PrivateKey:
+		return true
+	}
+	return false
+}
+
+// withSigningKeys returns a configure function that signs with the given key files, the first one active.
+func withSigningKeys(t *testing.T, keys ...SigningKeyConfig) func(*Config) {
+	return func(cfg *Config) {
+		cfg.Auth.SigningKeys = keys
+		cfg.Auth.ActiveKey = keys[0].ID
+		set, err := loadKeySet(cfg.Auth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cfg.Auth.keys = set
+	}
+}
+
+// restart returns the router of a new server that shares the store and Redis of env but uses other settings.
+func (e *testEnv) restart(configure ...func(*Config)) http.Handler {
+	cfg := defaultConfig()
+	cfg.Auth.JWTSecret = "test-secret"
+	for _, f := range configure {
+		f(cfg)
+	}
+	client := redis.NewClient(&redis.Options{Addr: e.redis.Addr()})
+	e.t.Cleanup(func() { client.Close() })
+	return newAPIServer(cfg, e.store, client, e.mailer).Router()
+}
+
+// tokenHeader returns the alg and kid of a signed token without verifying it.
+func tokenHeader(t *testing.T, raw string) (string, string) {
+	t.Helper()
+	token, _, err := jwt.NewParser().ParseUnverified(raw, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	kid, _ := token.Header["kid"].(string)
+	return token.Method.Alg(), kid
+}
+
+func TestSigningKeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := SigningKeyConfig{ID: "2026-01", File: writePEM(t, dir, "old", rsaKey)}
+	oldPublic := SigningKeyConfig{ID: "2026-01", File: writePEM(t, dir, "old-public", &rsaKey.PublicKey)}
+	newKey := SigningKeyConfig{ID: "2026-02", File: writePEM(t, dir, "new", edPrivate)}
+
+	env := newTestEnv(t, withSigningKeys(t, oldKey))
+	env.createAccount("alice", "passw0rd1", roleUser)
+	oldToken := env.login("alice", "passw0rd1").Token
+	if alg, kid := tokenHeader(t, oldToken); alg != "RS256" || kid != "2026-01" {
+		t.Fatalf("token signed with %s by %q, want RS256 by 2026-01", alg, kid)
+	}
+	expectStatus(t, env.do("GET", "/me", oldToken, nil), http.StatusOK)
+	jwks := decodeBody[JWKS](t, env.do("GET", "/.well-known/jwks.json", "", nil))
+	if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != "RSA" || jwks.Keys[0].N == "" || jwks.Keys[0].E != "AQAB" {
+		t.Fatalf("JWKS = %+v, want the RSA key", jwks)
+	}
+
+	// Rotate: sign with the new key and keep the public half of the old one for tokens still in use
+	env.handler = env.restart(withSigningKeys(t, newKey, oldPublic))
+	expectStatus(t, env.do("GET", "/me", oldToken, nil), http.StatusOK)
+	newToken := env.login("alice", "passw0rd1").Token
+	if alg, kid := tokenHeader(t, newToken); alg != "EdDSA" || kid != "2026-02" {
+		t.Fatalf("token signed with %s by %q, want EdDSA by 2026-02", alg, kid)
+	}
+	expectStatus(t, env.do("GET", "/me", newToken, nil), http.StatusOK)
+	jwks = decodeBody[JWKS](t, env.do("GET", "/.well-known/jwks.json", "", nil))
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "2026-01" || jwks.Keys[1].Kid != "2026-02" {
+		t.Fatalf("JWKS = %+v, want both keys", jwks)
+	}
+	if ed := jwks.Keys[1]; ed.Kty != "OKP" || ed.Crv != "Ed25519" || ed.X == "" || ed.N != "" {
+		t.Fatalf("Ed25519 JWK = %+v", ed)
+	}
+
+	// Once the old key is removed its tokens stop working
+	env.handler = env.restart(withSigningKeys(t, newKey))
+	expectStatus(t, env.do("GET", "/me", oldToken, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/me", newToken, nil), http.StatusOK)
+}
+
+func TestSigningKeysRejectForgedTokens(t *testing.T) {
+	dir := t.TempDir()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edPrivate, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := newTestEnv(t, withSigningKeys(t,
+		SigningKeyConfig{ID: "ed", File: writePEM(t, dir, "ed", edPrivate)},
+		SigningKeyConfig{ID: "rsa", File: writePEM(t, dir, "rsa", rsaKey)}))
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	claims := jwt.MapClaims{
+		"sub":  strconv.Itoa(account.ID),
+		"jti":  "forged",
+		"exp":  time.Now().Add(time.Minute).Unix(),
+		"role": account.RoleID,
+		"ver":  0,
+	}
+	sign := func(method jwt.SigningMethod, kid string, key interface{}) string {
+		token := jwt.NewWithClaims(method, claims)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		raw, err := token.SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+
+	// A correctly signed token passes, to show the claims are otherwise valid
+	expectStatus(t, env.do("GET", "/me", sign(jwt.SigningMethodRS256, "rsa", rsaKey), nil), http.StatusOK)
+	for name, raw := range map[string]string{
+		"HS256 with the secret":         sign(jwt.SigningMethodHS256, "", []byte("test-secret")),
+		"RS256 under the Ed25519 kid":   sign(jwt.SigningMethodRS256, "ed", rsaKey),
+		"unknown kid":                   sign(jwt.SigningMethodEdDSA, "other", edPrivate),
+		"no kid":                        sign(jwt.SigningMethodEdDSA, "", edPrivate),
+		"signed by an unconfigured key": sign(jwt.SigningMethodEdDSA, "ed", ed25519.NewKeyFromSeed(make([]byte, 32))),
+	} {
+		if rec := env.do("GET", "/me", raw, nil); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: status %d, want 401", name, rec.Code)
+		}
+	}
+}
+
+func TestLoadKeySetErrors(t *testing.T) {
+	dir := t.TempDir()
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAKey := filepath.Join(dir, "garbage.pem")
+	if err := os.WriteFile(notAKey, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		cfg  AuthConfig
+		want string
+	}{
+		{"public active key", AuthConfig{SigningKeys: []SigningKeyConfig{{ID: "pub", File: writePEM(t, dir, "pub", public)}}}, "must be a private key"},
+		{"not a key", AuthConfig{SigningKeys: []SigningKeyConfig{{ID: "bad", File: notAKey}}}, "not an RSA or Ed25519"},
+		{"missing file", AuthConfig{SigningKeys: []SigningKeyConfig{{ID: "gone", File: filepath.Join(dir, "gone.pem")}}}, "reading signing key gone"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadKeySet(tt.cfg); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("loadKeySet = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+	if set, err := loadKeySet(AuthConfig{}); set != nil || err != nil {
+		t.Fatalf("loadKeySet without keys = %v, %v; want nil, nil", set, err)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// lockoutEventsKey is the Redis stream lockout and unlock events are recorded in.
+const lockoutEventsKey = "lockout:events"
+
+// LockoutEvent is a recorded lockout or unlock of a username or client IP.
+type LockoutEvent struct {
+	ID       string    `json:"id"`
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`   // locked or unlocked
+	Subject  string    `json:"subject"` // user:<username> or ip:<address>
+	Failures int       `json:"failures,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// lockoutSubjects returns the subjects failed logins are counted for: the username and the client IP.
+func lockoutSubjects(username, ip string) []string {
+	return []string{"user:" + strings.ToLower(username), "ip:" + ip}
+}
+
+// lockoutFailKey returns the Redis key counting the failed logins of a subject.
+func lockoutFailKey(subject string) string {
+	return "lockout:fail:" + subject
+}
+
+// lockoutLockKey returns the Redis key that exists while a subject is locked.
+func lockoutLockKey(subject string) string {
+	return "lockout:lock:" + subject
+}
+
+// lockoutThreshold returns how many failures lock the subject.
+func lockoutThreshold(cfg LockoutConfig, subject string) int {
+	if strings.HasPrefix(subject, "ip:") {
+		return cfg.IPMaxAttempts
+	}
+	return cfg.MaxAttempts
+}
+
+// lockoutDelay returns how long the subject is locked after the given number of failures.
+// The delay doubles with every failure past the threshold, up to MaxDelay.
+func lockoutDelay(cfg LockoutConfig, failures, threshold int) time.Duration {
+	delay := cfg.BaseDelay
+	for i := threshold; i < failures && delay < cfg.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > cfg.MaxDelay {
+		delay = cfg.MaxDelay
+	}
+	return delay
+}
+
+// loginLockedFor returns how long logins for the username or from the IP stay locked, or zero.
+func loginLockedFor(ctx context.Context, client *redis.Client, username, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range lockoutSubjects(username, ip) {
+		ttl, err := client.PTTL(ctx, lockoutLockKey(subject)).Result()
+		if err != nil {
+			return 0, err
+		}
+		if ttl > wait {
+			wait = ttl
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginFailure counts a failed login and locks every subject that reached its threshold.
+// It returns how long the login is locked now, or zero.
+func recordLoginFailure(ctx context.Context, client *redis.Client, cfg LockoutConfig, username, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, subject := range lockoutSubjects(username, ip) {
+		failures, err := client.Incr(ctx, lockoutFailKey(subject)).Result()
+		if err != nil {
+			return 0, err
+		}
+		threshold := lockoutThreshold(cfg, subject)
+		if int(failures) < threshold {
+			if err := client.Expire(ctx, lockoutFailKey(subject), cfg.Window).Err(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		delay := lockoutDelay(cfg, int(failures), threshold)
+		// Keep counting past the lock, so the next failure after it escalates the delay
+		_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Expire(ctx, lockoutFailKey(subject), cfg.Window+delay)
+			pipe.Set(ctx, lockoutLockKey(subject), failures, delay)
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		recordLockoutEvent(ctx, client, LockoutEvent{Event: "locked", Subject: subject, Failures: int(failures), Duration: delay.String()})
+		if delay > wait {
+			wait = delay
+		}
+	}
+	return wait, nil
+}
+
+// recordLoginSuccess forgets the failed logins of the username. The IP counter is kept,
+// so one known password does not reset the limit for guessing others from the same address.
+func recordLoginSuccess(ctx context.Context, client *redis.Client, cfg LockoutConfig, username string) error {
+	subject := lockoutSubjects(username, "")[0]
+	failures, err := client.GetDel(ctx, lockoutFailKey(subject)).Int()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if failures >= cfg.MaxAttempts {
+		recordLockoutEvent(ctx, client, LockoutEvent{Event: "unlocked", Subject: subject, Failures: failures, Reason: "login succeeded after the lock expired"})
+	}
+	return nil
+}
+
+// clearLockout removes the lock and the failure count of a subject.
+func clearLockout(ctx context.Context, client *redis.Client, subject, by string) error {
+	if err := client.Del(ctx, lockoutLockKey(subject), lockoutFailKey(subject)).Err(); err != nil {
+		return err
+	}
+	recordLockoutEvent(ctx, client, LockoutEvent{Event: "unlocked", Subject: subject, Reason: "cleared by " + by})
+	return nil
+}
+
+// recordLockoutEvent logs the event and appends it to the capped event stream.
+// Failing to record is logged rather than returned, so it never blocks a login.
+func recordLockoutEvent(ctx context.Context, client *redis.Client, event LockoutEvent) {
+	log.Printf("login %s: %s failures=%d duration=%s %s", event.Event, event.Subject, event.Failures, event.Duration, event.Reason)
+	err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: lockoutEventsKey,
+		MaxLen: 10000,
+		Approx: true,
+		Values: map[string]interface{}{
+			"event":    event.Event,
+			"subject":  event.Subject,
+			"failures": event.Failures,
+			"duration": event.Duration,
+			"reason":   event.Reason,
+		},
+	}).Err()
+	if err != nil {
+		log.Printf("recording lockout event: %v", err)
+	}
+}
+
+// listLockoutEvents returns up to count of the most recent lockout events, newest first.
+func listLockoutEvents(ctx context.Context, client *redis.Client, count int64) ([]*LockoutEvent, error) {
+	messages, err := client.XRevRangeN(ctx, lockoutEventsKey, "+", "-", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]*LockoutEvent, 0, len(messages))
+	for _, msg := range messages {
+		event := &LockoutEvent{ID: msg.ID}
+		// Stream IDs start with the Unix time in milliseconds
+		if ms, err := strconv.ParseInt(strings.SplitN(msg.ID, "-", 2)[0], 10, 64); err == nil {
+			event.Time = time.UnixMilli(ms).UTC()
+		}
+		event.Event, _ = msg.Values["event"].(string)
+		event.Subject, _ = msg.Values["subject"].(string)
+		event.Duration, _ = msg.Values["duration"].(string)
+		event.Reason, _ = msg.Values["reason"].(string)
+		if failures, ok := msg.Values["failures"].(string); ok {
+			event.Failures, _ = strconv.Atoi(failures)
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
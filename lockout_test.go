@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLockoutDelay(t *testing.T) {
+	cfg := LockoutConfig{BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{50, 10 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := lockoutDelay(cfg, tt.failures, 3); got != tt.want {
+			t.Errorf("lockoutDelay(%d failures) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestLoginLockoutBacksOff(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) { cfg.Auth.Lockout.MaxAttempts = 3 })
+	env.createAccount("alice", "passw0rd1", roleUser)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	adminToken := env.login("admin", "passw0rd1").Token
+	wrong := LoginRequest{UserName: "alice", Password: "wrong-password"}
+
+	for i := 0; i < 2; i++ {
+		expectStatus(t, env.do("POST", "/login", "", wrong), http.StatusUnauthorized)
+	}
+	rec := env.do("POST", "/login", "", wrong)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if got := rec.Header().Get("Retry-After"); got != "60" {
+		t.Fatalf("Retry-After = %s, want 60", got)
+	}
+
+	// The right password does not get through while locked
+	expectStatus(t, env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"}), http.StatusTooManyRequests)
+
+	// The next failure after the lock expires doubles the delay
+	env.redis.FastForward(61 * time.Second)
+	rec = env.do("POST", "/login", "", wrong)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if got := rec.Header().Get("Retry-After"); got != "120" {
+		t.Fatalf("Retry-After = %s, want 120", got)
+	}
+
+	expectStatus(t, env.do("DELETE", "/lockouts?username=alice", adminToken, nil), http.StatusNoContent)
+	env.login("alice", "passw0rd1")
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Message is an outgoing plain-text e-mail.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends e-mail. NewMailer picks the implementation from the configuration.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// NewMailer creates the Mailer selected by cfg.Driver.
+func NewMailer(cfg MailConfig) (Mailer, error) {
+	switch cfg.Driver {
+	case "smtp":
+		return &SMTPMailer{cfg: cfg}, nil
+	case "file":
+		if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+			return nil, err
+		}
+		return &FileMailer{from: cfg.From, dir: cfg.Dir}, nil
+	case "log", "":
+		return &LogMailer{from: cfg.From}, nil
+	default:
+		return nil, fmt.Errorf("unknown mail driver %q", cfg.Driver)
+	}
+}
+
+// formatMessage renders the message with its headers as sent over SMTP.
+func formatMessage(from string, msg Message) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	b.WriteString(strings.ReplaceAll(msg.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// SMTPMailer sends e-mail through an SMTP server.
+type SMTPMailer struct {
+	cfg MailConfig
+}
+
+// smtpTimeout bounds a delivery whose context has no deadline of its own.
+const smtpTimeout = 30 * time.Second
+
+// Send delivers the message through the configured SMTP server. The context bounds the whole exchange,
+// so a stalled server cannot hold the sending goroutine.
+func (m *SMTPMailer) Send(ctx context.Context, msg Message) error {
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, smtpTimeout)
+		defer cancel()
+	}
+	host, _, err := net.SplitHostPort(m.cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", m.cfg.SMTPAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+	// Cancelling the context fails any read or write still waiting on the server
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if m.cfg.SMTPUsername != "" {
+		if err := client.Auth(smtp.PlainAuth("", m.cfg.SMTPUsername, m.cfg.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+	// The envelope takes the bare address, the From header keeps the display name
+	from := m.cfg.From
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	if err := client.Rcpt(msg.To); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(formatMessage(m.cfg.From, msg)); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// LogMailer writes e-mail to the server log instead of sending it. Meant for local development.
+// The tokens in links are redacted, since they work for anyone who reads the log; use the file
+// driver to follow the links locally.
+type LogMailer struct {
+	from string
+}
+
+// linkTokenPattern matches the token parameter of the verification and password reset links.
+var linkTokenPattern = regexp.MustCompile(`([?&]token=)[^&\s]+`)
+
+// Send logs the message with the link tokens redacted.
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	body := linkTokenPattern.ReplaceAllString(msg.Body, "${1}REDACTED")
+	log.Printf("mail to %s: %s\n%s", msg.To, msg.Subject, body)
+	return nil
+}
+
+// FileMailer stores each e-mail as an .eml file in a directory. Meant for local development and tests.
+type FileMailer struct {
+	from string
+	dir  string
+}
+
+// Send writes the message to a new file in the mail directory.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	name, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	file := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), name)
+	return os.WriteFile(filepath.Join(m.dir, file), formatMessage(m.from, msg), 0o644)
+}
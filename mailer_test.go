@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogMailerRedactsLinkTokens(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	msg := Message{To: "alice@example.com", Subject: "Reset your password",
+		Body: "Open http://localhost:1234/password/reset?token=c2VjcmV0.dG9rZW4%3D to choose a new password.\n"}
+	if err := (&LogMailer{}).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	logged := buf.String()
+	if strings.Contains(logged, "c2VjcmV0") {
+		t.Fatalf("token reached the log: %s", logged)
+	}
+	if !strings.Contains(logged, "/password/reset?token=REDACTED to choose") {
+		t.Fatalf("link missing from the log: %s", logged)
+	}
+}
+
+func TestFileMailerKeepsLinks(t *testing.T) {
+	dir := t.TempDir()
+	msg := Message{To: "alice@example.com", Subject: "Verify", Body: "http://localhost:1234/verify-email?token=abc\n"}
+	if err := (&FileMailer{from: "test@localhost", dir: dir}).Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("got files %v, %v; want one .eml file", files, err)
+	}
+	data, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "verify-email?token=abc") || !strings.Contains(string(data), "To: alice@example.com\r\n") {
+		t.Fatalf("unexpected message:\n%s", data)
+	}
+}
+
+// fakeSMTP accepts one connection and answers it with serve.
+func fakeSMTP(t *testing.T, serve func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(conn)
+	}()
+	return ln.Addr().String()
+}
+
+func TestSMTPMailerSends(t *testing.T) {
+	received := make(chan string, 1)
+	addr := fakeSMTP(t, func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		reply := func(line string) { conn.Write([]byte(line + "\r\n")) }
+		reply("220 localhost ready")
+		var transcript strings.Builder
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line)
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "MAIL"), strings.HasPrefix(cmd, "RCPT"):
+				reply("250 ok")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case cmd == "QUIT":
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				reply("502 not implemented")
+			}
+		}
+	})
+	mailer := &SMTPMailer{cfg: MailConfig{SMTPAddr: addr, From: "Dev-Tasks <no-reply@localhost>"}}
+	msg := Message{To: "alice@example.com", Subject: "Hello", Body: "Hi Alice\n"}
+	if err := mailer.Send(context.Background(), msg); err != nil {
+		t.Fatal(err)
+	}
+	transcript := <-received
+	for _, want := range []string{"MAIL FROM:<no-reply@localhost>", "RCPT TO:<alice@example.com>", "From: Dev-Tasks <no-reply@localhost>", "Hi Alice"} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("transcript lacks %q:\n%s", want, transcript)
+		}
+	}
+}
+
+func TestSMTPMailerGivesUpOnStalledServer(t *testing.T) {
+	// The server accepts the connection but never greets
+	addr := fakeSMTP(t, func(conn net.Conn) { io.Copy(io.Discard, conn) })
+	mailer := &SMTPMailer{cfg: MailConfig{SMTPAddr: addr, From: "no-reply@localhost"}}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := mailer.Send(ctx, Message{To: "alice@example.com", Subject: "Hello", Body: "Hi"}); err == nil {
+		t.Fatal("Send to a stalled server succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Send took %s despite a 100ms deadline", elapsed)
+	}
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	_ "github.com/swaggo/http-swagger"
+	"os"
 )
 
 // @title Dev-Tasks
@@ -10,22 +12,83 @@ import (
 // @description Blog app for adding learn materials.
 // @host localhost:1234
 // @BasePath /
+// @securityDefinitions.apikey BearerAuth
+// @in header
+// @name Authorization
+// @description Access token as "Bearer <token>". The legacy token header is still accepted but deprecated.
 func main() {
-	// Initialize database connections
-	store, err := NewPostgresDB()
-	redisClient := NewRedisDB()
+	inMemory := flag.Bool("inmemory", false, "keep data in memory instead of PostgreSQL (development only)")
+	configFile := flag.String("config", os.Getenv("CONFIG_FILE"), "optional YAML or JSON config file")
+	flag.Parse()
+
+	// Run the "migrate up|down|status" subcommand instead of the server
+	if flag.Arg(0) == "migrate" {
+		cfg, err := LoadMigrateConfig(*configFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		pg, err := NewPostgresDB(cfg.Database)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if err := runMigrateCommand(pg, flag.Args()[1:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	cfg, err := LoadConfig(*configFile)
 	if err != nil {
 		fmt.Println(err)
-		panic(err)
+		os.Exit(1)
 	}
 
-	// Ensure database schema is initialized
-	if err := store.InitDB(); err != nil {
+	// Initialize database connections
+	var store Storage
+	if *inMemory {
+		store = NewMemoryDB()
+	} else {
+		pg, err := NewPostgresDB(cfg.Database)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		// Ensure database schema is initialized
+		if err := pg.InitDB(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if cfg.Metrics.Enabled {
+			instrumentDB(pg.db)
+		}
+		store = pg
+	}
+	redisClient, err := NewRedisDB(cfg.Redis)
+	if err != nil {
 		fmt.Println(err)
-		panic(err)
+		os.Exit(1)
+	}
+	if cfg.Metrics.Enabled {
+		instrumentRedis(redisClient)
+	}
+	if cfg.Cache.AccountTTL > 0 {
+		store = NewCachedStorage(store, redisClient, cfg.Cache.AccountTTL)
 	}
 
 	// Initialize API server and start listening for requests
-	apiServer := newAPIServer(":1234", store, redisClient)
-	apiServer.Run()
+	mailer, err := NewMailer(cfg.Mail)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	apiServer := newAPIServer(cfg, store, redisClient, mailer)
+	if err := apiServer.Run(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Server stopped")
 }
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryDB is a thread-safe in-memory Storage implementation.
+// It is meant for tests and local development without PostgreSQL.
+type MemoryDB struct {
+	mu         sync.RWMutex
+	accounts   map[int]*Account
+	roles      map[int]*Role
+	posts      map[int]*Post
+	categories map[int]*Category
+	nextID     int
+}
+
+// NewMemoryDB creates a new, empty MemoryDB instance.
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{
+		accounts: make(map[int]*Account),
+		roles: map[int]*Role{
+			roleAdmin: {ID: roleAdmin, Name: "admin", Permissions: []string{
+				permListAccounts, permManageAccount, permAssignRole, permWritePost, permManagePost, permManageTerms}},
+			roleUser: {ID: roleUser, Name: "user", Permissions: []string{permWritePost}},
+		},
+		posts:      make(map[int]*Post),
+		categories: make(map[int]*Category),
+		nextID:     1,
+	}
+}
+
+// Ping always succeeds; there is nothing to reach.
+func (s *MemoryDB) Ping(ctx context.Context) error {
+	return nil
+}
+
+// Close does nothing; the data simply goes away with the process.
+func (s *MemoryDB) Close() error {
+	return nil
+}
+
+// CreateAccount stores a new account and assigns it an ID.
+func (s *MemoryDB) CreateAccount(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.accountConflict(account); err != nil {
+		return err
+	}
+	account.ID = s.nextID
+	s.nextID++
+	stored := *account
+	s.accounts[account.ID] = &stored
+	return nil
+}
+
+// ListAccounts returns one page of accounts matching the query.
+func (s *MemoryDB) ListAccounts(q AccountQuery) (*AccountPage, error) {
+	if _, ok := accountSortColumns[q.Sort]; !ok {
+		return nil, invalidField("sort", "cannot sort by %s", q.Sort)
+	}
+	// before reports whether a is ordered before b in the requested direction
+	before := func(a, b *Account) bool {
+		if q.Desc {
+			return compareAccounts(q.Sort, a, b) > 0
+		}
+		return compareAccounts(q.Sort, a, b) < 0
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	accounts := []*Account{}
+	for _, account := range s.accounts {
+		if q.Country != "" && account.Country != q.Country {
+			continue
+		}
+		if q.RoleID != 0 && account.RoleID != q.RoleID {
+			continue
+		}
+		if !q.CreatedAfter.IsZero() && !account.CreatedAt.After(q.CreatedAfter) {
+			continue
+		}
+		if q.After != nil && !before(q.After, account) {
+			continue
+		}
+		found := *account
+		accounts = append(accounts, &found)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return before(accounts[i], accounts[j]) })
+	if len(accounts) > q.Limit+1 {
+		accounts = accounts[:q.Limit+1]
+	}
+	return newAccountPage(q, accounts), nil
+}
+
+// GetAccountByID retrieves an account by its ID.
+func (s *MemoryDB) GetAccountByID(id int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, notFound("account %d not found", id)
+	}
+	found := *account
+	return &found, nil
+}
+
+// GetAccountByUsername retrieves the account with the given username, ignoring case.
+func (s *MemoryDB) GetAccountByUsername(username string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, account := range s.accounts {
+		if strings.EqualFold(account.Username, username) {
+			found := *account
+			return &found, nil
+		}
+	}
+	return nil, notFound("account %s not found", username)
+}
+
+// GetAccountByEmail retrieves the account with the given e-mail address, ignoring case.
+func (s *MemoryDB) GetAccountByEmail(email string) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, account := range s.accounts {
+		if account.Email != "" && strings.EqualFold(account.Email, email) {
+			found := *account
+			return &found, nil
+		}
+	}
+	return nil, notFound("account with e-mail %s not found", email)
+}
+
+// accountConflict returns a conflict error if another account already uses the username
+// or e-mail of the given one, ignoring case. The caller must hold mu.
+func (s *MemoryDB) accountConflict(account *Account) error {
+	for _, other := range s.accounts {
+		if other.ID == account.ID {
+			continue
+		}
+		if strings.EqualFold(other.Username, account.Username) {
+			return conflictField("username", "%s is already taken", account.Username)
+		}
+		if account.Email != "" && strings.EqualFold(other.Email, account.Email) {
+			return conflictField("email", "%s is already registered", account.Email)
+		}
+	}
+	return nil
+}
+
+// UpdateAccount replaces a stored account with the given one.
+// The password hash and token version are left alone, see SetPassword and BumpTokenVersion.
+func (s *MemoryDB) UpdateAccount(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.accounts[account.ID]
+	if !ok {
+		return notFound("account %d not found", account.ID)
+	}
+	if err := s.accountConflict(account); err != nil {
+		return err
+	}
+	stored := *account
+	stored.EncryptedPassword = existing.EncryptedPassword
+	stored.TokenVersion = existing.TokenVersion
+	s.accounts[account.ID] = &stored
+	return nil
+}
+
+// BumpTokenVersion increments the token version of the account and returns the new one.
+func (s *MemoryDB) BumpTokenVersion(id int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[id]
+	if !ok {
+		return 0, notFound("account %d not found", id)
+	}
+	account.TokenVersion++
+	return account.TokenVersion, nil
+}
+
+// SetPassword stores a new password hash, bumps the token version and returns the new one.
+func (s *MemoryDB) SetPassword(id int, hash string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, ok := s.accounts[id]
+	if !ok {
+		return 0, notFound("account %d not found", id)
+	}
+	account.EncryptedPassword = hash
+	account.TokenVersion++
+	return account.TokenVersion, nil
+}
+
+// DeleteAccount removes an account by its ID.
+func (s *MemoryDB) DeleteAccount(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.accounts, id)
+	return nil
+}
+
+// GetRole retrieves a role and its permissions by the role ID.
+func (s *MemoryDB) GetRole(id int) (*Role, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	role, ok := s.roles[id]
+	if !ok {
+		return nil, notFound("role %d not found", id)
+	}
+	found := *role
+	found.Permissions = append([]string{}, role.Permissions...)
+	return &found, nil
+}
+
+// CreatePost stores a new post and assigns it an ID.
+func (s *MemoryDB) CreatePost(post *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.slugTaken(post.Slug, 0) {
+		return conflict("slug %q is already in use", post.Slug)
+	}
+	if err := s.checkCategories(post.Categories); err != nil {
+		return err
+	}
+	post.ID = s.nextID
+	s.nextID++
+	s.posts[post.ID] = copyPost(post)
+	return nil
+}
+
+// GetPostByID retrieves a post by its ID.
+func (s *MemoryDB) GetPostByID(id int) (*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	post, ok := s.posts[id]
+	if !ok {
+		return nil, notFound("post %d not found", id)
+	}
+	return copyPost(post), nil
+}
+
+// ListPosts returns the posts matching the query, newest first.
+// Filtering by a category also matches posts in its subcategories.
+func (s *MemoryDB) ListPosts(q PostQuery) ([]*Post, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var categories map[string]bool
+	if q.Category != "" {
+		categories = s.subcategorySlugs(q.Category)
+	}
+	posts := []*Post{}
+	for _, post := range s.posts {
+		if q.Status != "" && post.Status != q.Status {
+			continue
+		}
+		if q.AuthorID != 0 && post.AuthorID != q.AuthorID {
+			continue
+		}
+		if q.Tag != "" && !containsString(post.Tags, q.Tag) {
+			continue
+		}
+		if categories != nil && !containsAny(post.Categories, categories) {
+			continue
+		}
+		posts = append(posts, copyPost(post))
+	}
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		}
+		return posts[i].ID > posts[j].ID
+	})
+	return posts, nil
+}
+
+// UpdatePost replaces a stored post with the given one.
+func (s *MemoryDB) UpdatePost(post *Post) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.posts[post.ID]; !ok {
+		return notFound("post %d not found", post.ID)
+	}
+	if s.slugTaken(post.Slug, post.ID) {
+		return conflict("slug %q is already in use", post.Slug)
+	}
+	if err := s.checkCategories(post.Categories); err != nil {
+		return err
+	}
+	s.posts[post.ID] = copyPost(post)
+	return nil
+}
+
+// DeletePost removes a post by its ID.
+func (s *MemoryDB) DeletePost(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.posts, id)
+	return nil
+}
+
+// slugTaken reports whether a post other than exceptID uses the slug. The caller must hold mu.
+func (s *MemoryDB) slugTaken(slug string, exceptID int) bool {
+	for _, post := range s.posts {
+		if post.Slug == slug && post.ID != exceptID {
+			return true
+		}
+	}
+	return false
+}
+
+// SearchPosts is a case-insensitive substring search over the title and body of published posts.
+// It stands in for the PostgreSQL full-text search; title matches rank above body matches.
+func (s *MemoryDB) SearchPosts(text string, limit int) ([]*SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	needle := strings.ToLower(text)
+	results := []*SearchResult{}
+	for _, post := range s.posts {
+		if post.Status != postPublished {
+			continue
+		}
+		var rank float64
+		if strings.Contains(strings.ToLower(post.Title), needle) {
+			rank += 1
+		}
+		if strings.Contains(strings.ToLower(post.Body), needle) {
+			rank += 0.5
+		}
+		if rank == 0 {
+			continue
+		}
+		results = append(results, &SearchResult{
+			Post:    copyPost(post),
+			Rank:    rank,
+			Snippet: highlight(post.Body, text),
+		})
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Rank != results[j].Rank {
+			return results[i].Rank > results[j].Rank
+		}
+		return results[i].Post.ID > results[j].Post.ID
+	})
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
+
+// highlight returns the part of body around the first match of text as escaped HTML, with the match wrapped in <mark>.
+func highlight(body, text string) string {
+	const context = 60
+	i := strings.Index(strings.ToLower(body), strings.ToLower(text))
+	if i < 0 || i+len(text) > len(body) {
+		if len(body) > 2*context {
+			return markSnippet(body[:2*context])
+		}
+		return markSnippet(body)
+	}
+	start, end := i-context, i+len(text)+context
+	if start < 0 {
+		start = 0
+	}
+	if end > len(body) {
+		end = len(body)
+	}
+	return markSnippet(body[start:i] + snippetStart + body[i:i+len(text)] + snippetStop + body[i+len(text):end])
+}
+
+// ListTags returns every tag in use with the number of published posts carrying it.
+func (s *MemoryDB) ListTags() ([]*TagCount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := map[string]int{}
+	for _, post := range s.posts {
+		for _, tag := range post.Tags {
+			if _, ok := counts[tag]; !ok {
+				counts[tag] = 0
+			}
+			if post.Status == postPublished {
+				counts[tag]++
+			}
+		}
+	}
+	tags := make([]*TagCount, 0, len(counts))
+	for name, count := range counts {
+		tags = append(tags, &TagCount{Name: name, PostCount: count})
+	}
+	sort.Slice(tags, func(i, j int) bool { return tags[i].Name < tags[j].Name })
+	return tags, nil
+}
+
+// CreateCategory stores a new category and assigns it an ID.
+func (s *MemoryDB) CreateCategory(category *Category) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.categories {
+		if c.Slug == category.Slug {
+			return conflict("category %q already exists", category.Slug)
+		}
+	}
+	if category.ParentID != nil {
+		if _, ok := s.categories[*category.ParentID]; !ok {
+			return invalidField("parentId", "parent category %d not found", *category.ParentID)
+		}
+	}
+	category.ID = s.nextID
+	s.nextID++
+	stored := *category
+	s.categories[category.ID] = &stored
+	return nil
+}
+
+// ListCategories returns every category ordered by name.
+func (s *MemoryDB) ListCategories() ([]*Category, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	categories := make([]*Category, 0, len(s.categories))
+	for _, category := range s.categories {
+		found := *category
+		categories = append(categories, &found)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Name < categories[j].Name })
+	return categories, nil
+}
+
+// checkCategories returns an error if any slug names no category. The caller must hold mu.
+func (s *MemoryDB) checkCategories(slugs []string) error {
+	for _, slug := range slugs {
+		found := false
+		for _, category := range s.categories {
+			if category.Slug == slug {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return invalidField("categories", "unknown category in %v", slugs)
+		}
+	}
+	return nil
+}
+
+// subcategorySlugs returns the slug of the category and of all its descendants. The caller must hold mu.
+func (s *MemoryDB) subcategorySlugs(slug string) map[string]bool {
+	slugs := map[string]bool{}
+	ids := map[int]bool{}
+	for _, category := range s.categories {
+		if category.Slug == slug {
+			slugs[slug] = true
+			ids[category.ID] = true
+		}
+	}
+	for grew := true; grew; {
+		grew = false
+		for _, category := range s.categories {
+			if category.ParentID != nil && ids[*category.ParentID] && !ids[category.ID] {
+				ids[category.ID] = true
+				slugs[category.Slug] = true
+				grew = true
+			}
+		}
+	}
+	return slugs
+}
+
+// copyPost returns a copy of the post that shares no slices with it.
+func copyPost(post *Post) *Post {
+	found := *post
+	found.Tags = append([]string{}, post.Tags...)
+	found.Categories = append([]string{}, post.Categories...)
+	return &found
+}
+
+// containsString reports whether values holds s.
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny reports whether any of values is in the set.
+func containsAny(values []string, set map[string]bool) bool {
+	for _, v := range values {
+		if set[v] {
+			return true
+		}
+	}
+	return false
+}
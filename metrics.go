@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// metricsNamespace prefixes every metric the service exports.
+const metricsNamespace = "devtasks"
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route template, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route template, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	redisDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "redis_command_duration_seconds",
+		Help:      "Redis command latency by command and outcome. Pipelines count as one command named pipeline.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"command", "status"})
+
+	authLogins = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_logins_total",
+		Help:      "Successful logins.",
+	})
+	authLoginFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_login_failures_total",
+		Help:      "Refused logins by reason: invalid_credentials, locked or unverified.",
+	}, []string{"reason"})
+	authLogouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_logouts_total",
+		Help:      "Logouts.",
+	})
+	authBlacklistHits = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "auth_blacklist_hits_total",
+		Help:      "Requests refused because their access token was revoked.",
+	})
+)
+
+// statusRecorder remembers the status code written through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader records the status before passing it on.
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write records an implicit 200 before passing the body on.
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// instrument is a middleware around the router that counts and times requests.
+// Requests are labelled with the route template rather than the path so account IDs do not
+// blow up the label set; requests no route matches are labelled "unmatched".
+func instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		var match mux.RouteMatch
+		if router.Match(r, &match) && match.Route != nil {
+			if template, err := match.Route.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		router.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves the Prometheus metrics to scrapes that send token as a bearer token.
+func metricsHandler(token string) http.Handler {
+	handler := promhttp.Handler()
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme, sent, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") || subtle.ConstantTimeCompare([]byte(strings.TrimSpace(sent)), []byte(token)) != 1 {
+			writeError(w, r, unauthorized("missing or invalid metrics token"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// instrumentDB exports the connection pool statistics of db.
+func instrumentDB(db *sql.DB) {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+}
+
+// instrumentRedis times every command of client and exports its connection pool statistics.
+func instrumentRedis(client *redis.Client) {
+	client.AddHook(redisMetricsHook{})
+	poolStat := func(name, help string, value func(*redis.PoolStats) uint32) prometheus.Collector {
+		opts := prometheus.Opts{Namespace: metricsNamespace, Name: "redis_pool_" + name, Help: help}
+		read := func() float64 { return float64(value(client.PoolStats())) }
+		if strings.HasSuffix(name, "_total") {
+			return prometheus.NewCounterFunc(prometheus.CounterOpts(opts), read)
+		}
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts(opts), read)
+	}
+	prometheus.MustRegister(
+		poolStat("hits_total", "Times a free connection was found in the pool.", func(s *redis.PoolStats) uint32 { return s.Hits }),
+		poolStat("misses_total", "Times no free connection was found in the pool.", func(s *redis.PoolStats) uint32 { return s.Misses }),
+		poolStat("timeouts_total", "Times waiting for a connection timed out.", func(s *redis.PoolStats) uint32 { return s.Timeouts }),
+		poolStat("stale_conns_total", "Stale connections removed from the pool.", func(s *redis.PoolStats) uint32 { return s.StaleConns }),
+		poolStat("total_conns", "Connections in the pool.", func(s *redis.PoolStats) uint32 { return s.TotalConns }),
+		poolStat("idle_conns", "Idle connections in the pool.", func(s *redis.PoolStats) uint32 { return s.IdleConns }),
+	)
+}
+
+// redisMetricsHook observes the latency of Redis commands and pipelines.
+type redisMetricsHook struct{}
+
+// DialHook leaves dialing alone.
+func (redisMetricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+// ProcessHook times a single command.
+func (redisMetricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		redisDuration.WithLabelValues(cmd.Name(), redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// ProcessPipelineHook times a pipeline or transaction as a whole.
+func (redisMetricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		redisDuration.WithLabelValues("pipeline", redisStatus(err)).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// redisStatus labels a command outcome. A missing key is a normal answer, not an error.
+func redisStatus(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil, err == redis.Nil:
+		return "ok"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withMetrics enables the metrics endpoint behind the token "scrape-token".
+func withMetrics(cfg *Config) {
+	cfg.Metrics.Enabled = true
+	cfg.Metrics.Token = "scrape-token"
+}
+
+func TestMetricsEndpointNeedsToken(t *testing.T) {
+	env := newTestEnv(t, withMetrics)
+	expectStatus(t, env.do("GET", "/metrics", "", nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/metrics", "wrong-token", nil), http.StatusUnauthorized)
+	rec := env.do("GET", "/metrics", "scrape-token", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "devtasks_http_requests_total") {
+		t.Fatalf("scrape lacks the request counter:\n%s", rec.Body)
+	}
+}
+
+func TestMetricsEndpointOffByDefault(t *testing.T) {
+	env := newTestEnv(t)
+	expectStatus(t, env.do("GET", "/metrics", "", nil), http.StatusNotFound)
+	expectStatus(t, env.do("GET", "/metrics", "anything", nil), http.StatusNotFound)
+}
+
+func TestRequestsAreCountedByRouteTemplate(t *testing.T) {
+	env := newTestEnv(t, withMetrics)
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+	// The counters are shared by the whole test binary, so only their growth is checked
+	byID := httpRequests.WithLabelValues("/account/{id}", "GET", "200")
+	unmatched := httpRequests.WithLabelValues("unmatched", "GET", "404")
+	byIDBefore, unmatchedBefore := testutil.ToFloat64(byID), testutil.ToFloat64(unmatched)
+
+	expectStatus(t, env.do("GET", "/account/"+strconv.Itoa(account.ID), token, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/no/such/route", "", nil), http.StatusNotFound)
+	if got := testutil.ToFloat64(byID) - byIDBefore; got != 1 {
+		t.Errorf("/account/{id} counted %v times, want 1", got)
+	}
+	if got := testutil.ToFloat64(unmatched) - unmatchedBefore; got != 1 {
+		t.Errorf("unmatched route counted %v times, want 1", got)
+	}
+
+	rec := env.do("GET", "/metrics", "scrape-token", nil)
+	expectStatus(t, rec, http.StatusOK)
+	want := `devtasks_http_requests_total{method="GET",route="/account/{id}",status="200"}`
+	if !strings.Contains(rec.Body.String(), want) {
+		t.Fatalf("scrape lacks %s", want)
+	}
+	if strings.Contains(rec.Body.String(), `route="/account/`+strconv.Itoa(account.ID)+`"`) {
+		t.Fatal("scrape labels a request with its path instead of its route template")
+	}
+}
+
+func TestAuthEventsAreCounted(t *testing.T) {
+	env := newTestEnv(t, withMetrics)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	invalid := authLoginFailures.WithLabelValues("invalid_credentials")
+	before := [4]float64{testutil.ToFloat64(authLogins), testutil.ToFloat64(invalid), testutil.ToFloat64(authLogouts), testutil.ToFloat64(authBlacklistHits)}
+
+	expectStatus(t, env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "wrong-password1"}), http.StatusUnauthorized)
+	token := env.login("alice", "passw0rd1").Token
+	expectStatus(t, env.do("POST", "/logout", token, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/me", token, nil), http.StatusUnauthorized)
+
+	after := [4]float64{testutil.ToFloat64(authLogins), testutil.ToFloat64(invalid), testutil.ToFloat64(authLogouts), testutil.ToFloat64(authBlacklistHits)}
+	for i, name := range []string{"logins", "invalid credentials", "logouts", "blacklist hits"} {
+		if got := after[i] - before[i]; got != 1 {
+			t.Errorf("%s grew by %v, want 1", name, got)
+		}
+	}
+}
@@ -0,0 +1,19 @@
+-- IF NOT EXISTS keeps this baseline safe on databases created before migrations existed.
+CREATE TABLE IF NOT EXISTS role (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(50) UNIQUE
+);
+
+INSERT INTO role (name) VALUES ('admin'), ('user') ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS account (
+	id SERIAL PRIMARY KEY,
+	firstName VARCHAR(255),
+	lastName VARCHAR(255),
+	email VARCHAR(255),
+	username VARCHAR(255),
+	hash VARCHAR(255),
+	country VARCHAR(255),
+	roleID INT REFERENCES role(id),
+	createdAt TIMESTAMP
+);
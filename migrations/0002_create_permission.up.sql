@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS permission (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS role_permission (
+	roleID INT REFERENCES role(id) ON DELETE CASCADE,
+	permissionID INT REFERENCES permission(id) ON DELETE CASCADE,
+	PRIMARY KEY (roleID, permissionID)
+);
+
+INSERT INTO permission (name)
+VALUES ('account:list'), ('account:manage'), ('account:assign-role')
+ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (roleID, permissionID)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p WHERE r.name = 'admin'
+ON CONFLICT DO NOTHING;
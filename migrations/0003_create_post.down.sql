@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS post;
+DELETE FROM permission WHERE name IN ('post:write', 'post:manage');
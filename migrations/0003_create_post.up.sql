@@ -0,0 +1,21 @@
+CREATE TABLE post (
+	id SERIAL PRIMARY KEY,
+	authorID INT NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+	title VARCHAR(255) NOT NULL,
+	slug VARCHAR(255) NOT NULL UNIQUE,
+	body TEXT NOT NULL DEFAULT '',
+	status VARCHAR(20) NOT NULL DEFAULT 'draft' CHECK (status IN ('draft', 'published')),
+	createdAt TIMESTAMP NOT NULL,
+	updatedAt TIMESTAMP NOT NULL
+);
+
+CREATE INDEX post_status_createdAt_idx ON post (status, createdAt DESC);
+CREATE INDEX post_authorID_idx ON post (authorID);
+
+INSERT INTO permission (name) VALUES ('post:write'), ('post:manage') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (roleID, permissionID)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p
+WHERE (r.name = 'admin' AND p.name IN ('post:write', 'post:manage'))
+   OR (r.name = 'user' AND p.name = 'post:write')
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS post_category;
+DROP TABLE IF EXISTS post_tag;
+DROP TABLE IF EXISTS category;
+DROP TABLE IF EXISTS tag;
+DELETE FROM permission WHERE name = 'category:manage';
@@ -0,0 +1,36 @@
+CREATE TABLE tag (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL UNIQUE
+);
+
+CREATE TABLE category (
+	id SERIAL PRIMARY KEY,
+	name VARCHAR(100) NOT NULL,
+	slug VARCHAR(100) NOT NULL UNIQUE,
+	parentID INT REFERENCES category(id) ON DELETE SET NULL
+);
+
+CREATE INDEX category_parentID_idx ON category (parentID);
+
+CREATE TABLE post_tag (
+	postID INT NOT NULL REFERENCES post(id) ON DELETE CASCADE,
+	tagID INT NOT NULL REFERENCES tag(id) ON DELETE CASCADE,
+	PRIMARY KEY (postID, tagID)
+);
+
+CREATE INDEX post_tag_tagID_idx ON post_tag (tagID);
+
+CREATE TABLE post_category (
+	postID INT NOT NULL REFERENCES post(id) ON DELETE CASCADE,
+	categoryID INT NOT NULL REFERENCES category(id) ON DELETE CASCADE,
+	PRIMARY KEY (postID, categoryID)
+);
+
+CREATE INDEX post_category_categoryID_idx ON post_category (categoryID);
+
+INSERT INTO permission (name) VALUES ('category:manage') ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO role_permission (roleID, permissionID)
+SELECT r.id, p.id FROM role r CROSS JOIN permission p
+WHERE r.name = 'admin' AND p.name = 'category:manage'
+ON CONFLICT DO NOTHING;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS account_email_key;
+DROP INDEX IF EXISTS account_username_key;
+DROP TABLE IF EXISTS account_dedupe;
@@ -0,0 +1,36 @@
+-- Existing duplicates would make the unique indexes fail, so every duplicate but the oldest
+-- account is changed first: usernames get an -<id> suffix and e-mails are cleared.
+-- The original values are kept in account_dedupe for follow-up.
+CREATE TABLE account_dedupe (
+	accountID INT NOT NULL REFERENCES account(id) ON DELETE CASCADE,
+	field VARCHAR(50) NOT NULL,
+	originalValue VARCHAR(255) NOT NULL,
+	dedupedAt TIMESTAMP NOT NULL DEFAULT now()
+);
+
+WITH duplicate AS (
+	SELECT id, username FROM (
+		SELECT id, username, row_number() OVER (PARTITION BY lower(username) ORDER BY id) AS n
+		FROM account WHERE username IS NOT NULL
+	) ranked WHERE n > 1
+), logged AS (
+	INSERT INTO account_dedupe (accountID, field, originalValue)
+	SELECT id, 'username', username FROM duplicate
+)
+UPDATE account SET username = account.username || '-' || account.id
+FROM duplicate WHERE account.id = duplicate.id;
+
+WITH duplicate AS (
+	SELECT id, email FROM (
+		SELECT id, email, row_number() OVER (PARTITION BY lower(email) ORDER BY id) AS n
+		FROM account WHERE email IS NOT NULL AND email <> ''
+	) ranked WHERE n > 1
+), logged AS (
+	INSERT INTO account_dedupe (accountID, field, originalValue)
+	SELECT id, 'email', email FROM duplicate
+)
+UPDATE account SET email = ''
+FROM duplicate WHERE account.id = duplicate.id;
+
+CREATE UNIQUE INDEX account_username_key ON account (lower(username));
+CREATE UNIQUE INDEX account_email_key ON account (lower(email)) WHERE email <> '';
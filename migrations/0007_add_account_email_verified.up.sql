@@ -0,0 +1,4 @@
+ALTER TABLE account ADD COLUMN emailVerified BOOLEAN NOT NULL DEFAULT false;
+
+-- Accounts that existed before verification was introduced keep being able to log in.
+UPDATE account SET emailVerified = true;
@@ -0,0 +1 @@
+ALTER TABLE account DROP COLUMN IF EXISTS tokenVersion;
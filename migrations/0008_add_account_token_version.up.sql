@@ -0,0 +1,2 @@
+-- Bumped whenever every token issued to the account so far must stop working
+ALTER TABLE account ADD COLUMN tokenVersion INT NOT NULL DEFAULT 0;
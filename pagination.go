@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page size limits for account listing.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// accountSortColumns whitelists the fields accounts can be sorted by, mapped to their column.
+var accountSortColumns = map[string]string{
+	"id":        "id",
+	"createdAt": "createdAt",
+	"username":  "username",
+	"country":   "country",
+}
+
+// AccountQuery selects, orders and pages the accounts ListAccounts returns. Zero values do not filter.
+type AccountQuery struct {
+	Limit        int
+	Sort         string   // key of accountSortColumns, ties are broken by id
+	Desc         bool     // sort descending
+	After        *Account // keyset position: only accounts ordered after it are returned
+	Country      string
+	RoleID       int
+	CreatedAfter time.Time
+}
+
+// AccountPage represents one page of accounts and the cursor of the next page.
+type AccountPage struct {
+	Items      []*Account `json:"items"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+// accountCursor is the decoded form of AccountPage.NextCursor.
+// It records the ordering so a cursor cannot be replayed against a different sort.
+type accountCursor struct {
+	Sort  string `json:"s"`
+	Desc  bool   `json:"d"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+// accountSortValue returns the value of the sort field of the account.
+func accountSortValue(sort string, account *Account) interface{} {
+	switch sort {
+	case "createdAt":
+		return account.CreatedAt
+	case "username":
+		return account.Username
+	case "country":
+		return account.Country
+	default:
+		return account.ID
+	}
+}
+
+// compareAccounts orders two accounts by the sort field, then by ID.
+func compareAccounts(sort string, a, b *Account) int {
+	var c int
+	switch sort {
+	case "createdAt":
+		c = a.CreatedAt.Compare(b.CreatedAt)
+	case "username":
+		c = strings.Compare(a.Username, b.Username)
+	case "country":
+		c = strings.Compare(a.Country, b.Country)
+	}
+	if c != 0 {
+		return c
+	}
+	switch {
+	case a.ID < b.ID:
+		return -1
+	case a.ID > b.ID:
+		return 1
+	}
+	return 0
+}
+
+// encodeAccountCursor returns the cursor pointing just after the given account.
+func encodeAccountCursor(q AccountQuery, last *Account) string {
+	c := accountCursor{Sort: q.Sort, Desc: q.Desc, ID: last.ID}
+	switch v := accountSortValue(q.Sort, last).(type) {
+	case time.Time:
+		c.Value = v.Format(time.RFC3339Nano)
+	case string:
+		c.Value = v
+	case int:
+		c.Value = strconv.Itoa(v)
+	}
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeAccountCursor turns a cursor back into the keyset position of the query.
+func decodeAccountCursor(q AccountQuery, cursor string) (*Account, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, invalidField("cursor", "invalid cursor")
+	}
+	var c accountCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, invalidField("cursor", "invalid cursor")
+	}
+	if c.Sort != q.Sort || c.Desc != q.Desc {
+		return nil, invalidField("cursor", "cursor does not match sort %s", q.Sort)
+	}
+	position := &Account{ID: c.ID}
+	switch c.Sort {
+	case "createdAt":
+		if position.CreatedAt, err = time.Parse(time.RFC3339Nano, c.Value); err != nil {
+			return nil, invalidField("cursor", "invalid cursor")
+		}
+	case "username":
+		position.Username = c.Value
+	case "country":
+		position.Country = c.Value
+	}
+	return position, nil
+}
+
+// parseAccountQuery reads the listing parameters limit, cursor, sort, country, role and createdAfter.
+// A sort prefixed with '-' is descending.
+func parseAccountQuery(values url.Values) (AccountQuery, error) {
+	get := values.Get
+	q := AccountQuery{Limit: defaultPageSize, Sort: "id", Country: get("country")}
+	if v := get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			return q, invalidField("limit", "must be between 1 and %d", maxPageSize)
+		}
+		q.Limit = n
+	}
+	if v := get("sort"); v != "" {
+		q.Desc = strings.HasPrefix(v, "-")
+		q.Sort = strings.TrimPrefix(v, "-")
+		if _, ok := accountSortColumns[q.Sort]; !ok {
+			return q, invalidField("sort", "cannot sort by %s", q.Sort)
+		}
+	}
+	if v := get("role"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return q, invalidField("role", "invalid role %s", v)
+		}
+		q.RoleID = n
+	}
+	if v := get("createdAfter"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return q, invalidField("createdAfter", "must be an RFC 3339 timestamp")
+		}
+		q.CreatedAfter = t
+	}
+	if v := get("cursor"); v != "" {
+		after, err := decodeAccountCursor(q, v)
+		if err != nil {
+			return q, err
+		}
+		q.After = after
+	}
+	return q, nil
+}
+
+// newAccountPage trims a result fetched with Limit+1 rows to the page size and sets the next cursor.
+func newAccountPage(q AccountQuery, accounts []*Account) *AccountPage {
+	page := &AccountPage{Items: accounts}
+	if len(accounts) > q.Limit {
+		page.Items = accounts[:q.Limit]
+		page.NextCursor = encodeAccountCursor(q, page.Items[q.Limit-1])
+	}
+	return page
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestListAccountsKeysetPaging(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	for _, username := range []string{"erin", "carol", "alice", "dave", "bob"} {
+		env.createAccount(username, "passw0rd1", roleUser)
+	}
+	token := env.login("admin", "passw0rd1").Token
+
+	for _, tt := range []struct {
+		sort string
+		want []string
+	}{
+		{"username", []string{"admin", "alice", "bob", "carol", "dave", "erin"}},
+		{"-username", []string{"erin", "dave", "carol", "bob", "alice", "admin"}},
+	} {
+		var got []string
+		cursor := ""
+		for pages := 0; ; pages++ {
+			if pages > len(tt.want) {
+				t.Fatalf("sort %s: paging does not end", tt.sort)
+			}
+			rec := env.do("GET", "/account?limit=4&sort="+tt.sort+"&cursor="+url.QueryEscape(cursor), token, nil)
+			expectStatus(t, rec, http.StatusOK)
+			page := decodeBody[AccountPage](t, rec)
+			for _, account := range page.Items {
+				got = append(got, account.Username)
+			}
+			if cursor = page.NextCursor; cursor == "" {
+				break
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Fatalf("sort %s: got %v, want %v", tt.sort, got, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("sort %s: got %v, want %v", tt.sort, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestListAccountsRejectsForeignCursor(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("admin", "passw0rd1").Token
+
+	rec := env.do("GET", "/account?limit=1&sort=username", token, nil)
+	expectStatus(t, rec, http.StatusOK)
+	cursor := decodeBody[AccountPage](t, rec).NextCursor
+	if cursor == "" {
+		t.Fatal("first page has no cursor")
+	}
+	expectStatus(t, env.do("GET", "/account?limit=1&sort=country&cursor="+url.QueryEscape(cursor), token, nil), http.StatusBadRequest)
+	expectStatus(t, env.do("GET", "/account?cursor=not-a-cursor", token, nil), http.StatusBadRequest)
+	expectStatus(t, env.do("GET", "/account?sort=password", token, nil), http.StatusBadRequest)
+	expectStatus(t, env.do("GET", "/account?limit=0", token, nil), http.StatusBadRequest)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// passwordResetRecord is the value stored in Redis for each issued password reset token.
+type passwordResetRecord struct {
+	AccountID int    `json:"accountId"`
+	Email     string `json:"email"`
+}
+
+// passwordResetKey returns the Redis key of a password reset token. Only the token hash is stored.
+func passwordResetKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "password-reset:" + hex.EncodeToString(sum[:])
+}
+
+// issuePasswordResetToken creates a reset token for the account's current e-mail address that expires after ttl.
+func issuePasswordResetToken(ctx context.Context, client *redis.Client, ttl time.Duration, account *Account) (string, error) {
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	record, err := json.Marshal(passwordResetRecord{AccountID: account.ID, Email: account.Email})
+	if err != nil {
+		return "", err
+	}
+	if err := client.Set(ctx, passwordResetKey(token), record, ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// consumePasswordResetToken deletes a reset token and returns what it was issued for.
+// Each token can be consumed once.
+func consumePasswordResetToken(ctx context.Context, client *redis.Client, token string) (*passwordResetRecord, error) {
+	data, err := client.GetDel(ctx, passwordResetKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, invalidField("token", "invalid or expired reset token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := new(passwordResetRecord)
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// sendPasswordResetEmail mails the account a link to choose a new password.
+// Failures are logged rather than returned, so the response does not reveal whether the account exists.
+func (s *APIServer) sendPasswordResetEmail(ctx context.Context, account *Account) {
+	token, err := issuePasswordResetToken(ctx, s.redisClient, s.auth.PasswordResetTTL, account)
+	if err != nil {
+		log.Printf("creating password reset token for account %d: %v", account.ID, err)
+		return
+	}
+	link := s.publicURL + "/password/reset?token=" + url.QueryEscape(token)
+	msg := Message{
+		To:      account.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account %s. "+
+			"If it was you, open this link to choose a new one:\n\n%s\n\n"+
+			"The link expires in %s. If you did not ask for it, you can ignore this mail.\n",
+			account.FirstName, account.Username, link, s.auth.PasswordResetTTL),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		log.Printf("sending password reset mail to account %d: %v", account.ID, err)
+	}
+}
+
+// resetPassword sets the new password of the account the reset token was issued for
+// and revokes all of its access and refresh tokens.
+func (s *APIServer) resetPassword(ctx context.Context, req *ResetPasswordRequest) error {
+	record, err := consumePasswordResetToken(ctx, s.redisClient, req.Token)
+	if err != nil {
+		return err
+	}
+	account, err := s.dbStore.GetAccountByID(record.AccountID)
+	var domainErr *DomainError
+	if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+		return invalidField("token", "invalid or expired reset token")
+	}
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(account.Email, record.Email) {
+		return invalidField("token", "the e-mail address has changed since this link was sent")
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	// The reset link reached the mailbox, which proves the address as well
+	if !account.EmailVerified {
+		account.EmailVerified = true
+		if err := s.dbStore.UpdateAccount(account); err != nil {
+			return err
+		}
+	}
+	_, err = s.setPassword(ctx, account.ID, hash)
+	return err
+}
+
+// resetPasswordView is what the reset page shows.
+type resetPasswordView struct {
+	Token  string
+	Errors []string
+	Done   bool
+}
+
+// resetPasswordPage is the page the mailed reset link opens. Its form posts back to the same URL.
+var resetPasswordPage = template.Must(template.New("reset").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Reset your password</title>
+</head>
+<body>
+<h1>Reset your password</h1>
+{{if .Done}}<p>Your password has been changed. You can log in with it now.</p>
+{{else}}{{range .Errors}}<p role="alert">{{.}}</p>
+{{end}}<form method="post">
+<input type="hidden" name="token" value="{{.Token}}">
+<label>New password <input type="password" name="password" autocomplete="new-password" required></label>
+<button type="submit">Change password</button>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// renderResetPasswordPage writes the reset page. The token is in the URL, so the page is neither cached
+// nor allowed to leak it through the Referer header, and it cannot be framed.
+func renderResetPasswordPage(w http.ResponseWriter, status int, view resetPasswordView) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; form-action 'self'; frame-ancestors 'none'")
+	w.WriteHeader(status)
+	return resetPasswordPage.Execute(w, view)
+}
+
+// isFormPost reports whether the request body is an HTML form.
+func isFormPost(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/x-www-form-urlencoded"
+}
+
+// decodeResetPasswordForm reads a reset request posted by the reset page and validates it.
+func (s *APIServer) decodeResetPasswordForm(w http.ResponseWriter, r *http.Request, req *ResetPasswordRequest) error {
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxBodyBytes)
+	if err := r.ParseForm(); err != nil {
+		return invalid("invalid form body")
+	}
+	req.Token = r.PostFormValue("token")
+	req.Password = r.PostFormValue("password")
+	return s.validator.Struct(req)
+}
+
+// resetPasswordFormResult answers a form post from the reset page with the page itself, showing what went wrong
+// if the reset failed. Internal errors are returned to be logged and answered as usual.
+func resetPasswordFormResult(w http.ResponseWriter, token string, err error) error {
+	if err == nil {
+		return renderResetPasswordPage(w, http.StatusOK, resetPasswordView{Done: true})
+	}
+	var domainErr *DomainError
+	if !errors.As(err, &domainErr) || domainErr.Kind == KindInternal {
+		return err
+	}
+	view := resetPasswordView{Token: token}
+	for _, field := range domainErr.Fields {
+		if field.Field == "password" {
+			view.Errors = append(view.Errors, "The new password "+field.Message)
+		} else {
+			view.Errors = append(view.Errors, field.Message)
+		}
+	}
+	if len(view.Errors) == 0 {
+		view.Errors = []string{domainErr.Message}
+	}
+	return renderResetPasswordPage(w, domainErr.Kind.status(), view)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	old := env.login("alice", "passw0rd1")
+
+	// Unknown addresses get the same answer and no mail
+	expectStatus(t, env.do("POST", "/password/forgot", "", ForgotPasswordRequest{Email: "nobody@example.com"}), http.StatusAccepted)
+	env.server.background.Wait()
+	if sent := env.mailer.sent(); len(sent) != 0 {
+		t.Fatalf("mailed %d messages for an unknown address", len(sent))
+	}
+
+	expectStatus(t, env.do("POST", "/password/forgot", "", ForgotPasswordRequest{Email: "alice@example.com"}), http.StatusAccepted)
+	link := env.mailedLink()
+	rec := env.do("GET", link, "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Header().Get("Content-Type"), "text/html") || !strings.Contains(rec.Body.String(), "<form") {
+		t.Fatalf("reset link does not open a form: %s", rec.Body)
+	}
+
+	token := strings.TrimPrefix(link, "/password/reset?token=")
+	token, _ = url.QueryUnescape(token)
+	rec = env.do("POST", "/password/reset", "", ResetPasswordRequest{Token: token, Password: "weak"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	expectStatus(t, env.do("POST", "/password/reset", "", ResetPasswordRequest{Token: token, Password: "n3wpassword"}), http.StatusNoContent)
+	expectStatus(t, env.do("POST", "/password/reset", "", ResetPasswordRequest{Token: token, Password: "an0therpass"}), http.StatusBadRequest)
+	expectStatus(t, env.do("GET", "/me", old.Token, nil), http.StatusUnauthorized)
+	env.login("alice", "n3wpassword")
+}
+
+func TestPasswordResetForm(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	expectStatus(t, env.do("POST", "/password/forgot", "", ForgotPasswordRequest{Email: "alice@example.com"}), http.StatusAccepted)
+	link := env.mailedLink()
+	token, _ := url.QueryUnescape(strings.TrimPrefix(link, "/password/reset?token="))
+
+	post := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"token": {token}, "password": {password}}
+		req := httptest.NewRequest("POST", link, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		env.handler.ServeHTTP(rec, req)
+		return rec
+	}
+	rec := post("weak")
+	expectStatus(t, rec, http.StatusBadRequest)
+	if !strings.Contains(rec.Body.String(), "The new password must be at least") {
+		t.Fatalf("form does not explain the rejected password: %s", rec.Body)
+	}
+	rec = post("n3wpassword")
+	expectStatus(t, rec, http.StatusOK)
+	if !strings.Contains(rec.Body.String(), "has been changed") {
+		t.Fatalf("form does not confirm the change: %s", rec.Body)
+	}
+	env.login("alice", "n3wpassword")
+}
+
+func TestChangePasswordRevokesEarlierTokens(t *testing.T) {
+	env := newTestEnv(t)
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	old := env.login("alice", "passw0rd1")
+	path := "/account/" + strconv.Itoa(account.ID) + "/password"
+
+	rec := env.do("POST", path, old.Token, ChangePasswordRequest{CurrentPassword: "wrong", NewPassword: "n3wpassword"})
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	rec = env.do("POST", path, old.Token, ChangePasswordRequest{CurrentPassword: "passw0rd1", NewPassword: "n3wpassword"})
+	expectStatus(t, rec, http.StatusOK)
+	fresh := decodeBody[LoginResponse](t, rec)
+
+	expectStatus(t, env.do("GET", "/me", old.Token, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: old.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/me", fresh.Token, nil), http.StatusOK)
+	expectStatus(t, env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"}), http.StatusUnauthorized)
+	env.login("alice", "n3wpassword")
+}
+
+func TestChangePasswordWithAccountCache(t *testing.T) {
+	store := NewMemoryDB()
+	env := newTestEnvWithStore(t, store)
+	env.store = NewCachedStorage(store, env.server.redisClient, time.Minute)
+	env.server.dbStore = env.store
+	account := env.createAccount("alice", "passw0rd1", roleUser)
+	old := env.login("alice", "passw0rd1")
+	path := "/account/" + strconv.Itoa(account.ID) + "/password"
+
+	// Warm the cache, then change the password through the cached account
+	expectStatus(t, env.do("GET", "/me", old.Token, nil), http.StatusOK)
+	rec := env.do("POST", path, old.Token, ChangePasswordRequest{CurrentPassword: "passw0rd1", NewPassword: "n3wpassword"})
+	expectStatus(t, rec, http.StatusOK)
+
+	expectStatus(t, env.do("GET", "/me", old.Token, nil), http.StatusUnauthorized)
+	expectStatus(t, env.do("GET", "/me", decodeBody[LoginResponse](t, rec).Token, nil), http.StatusOK)
+	env.login("alice", "n3wpassword")
+}
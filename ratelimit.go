@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+	redis "github.com/redis/go-redis/v9"
+)
+
+// rateLimitResult is the outcome of counting one request against a rule.
+type rateLimitResult struct {
+	allowed   bool
+	remaining int
+	reset     time.Duration // until the current window ends
+}
+
+// rateLimiter counts requests per key with a sliding window: the count of the previous fixed window
+// is weighted by how much of it still overlaps the sliding one.
+type rateLimiter interface {
+	allow(ctx context.Context, key string, rule RateLimitRule) (rateLimitResult, error)
+}
+
+// slidingWindow evaluates a request given the counts of the current and previous windows,
+// the current one already including the request.
+func slidingWindow(rule RateLimitRule, now time.Time, current, previous int64) rateLimitResult {
+	elapsed := time.Duration(now.UnixNano() % int64(rule.Window))
+	weight := 1 - float64(elapsed)/float64(rule.Window)
+	count := int(math.Ceil(float64(previous)*weight)) + int(current)
+	remaining := rule.Requests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	return rateLimitResult{allowed: count <= rule.Requests, remaining: remaining, reset: rule.Window - elapsed}
+}
+
+// redisRateLimiter keeps the window counters in Redis, so every instance shares the limits.
+type redisRateLimiter struct {
+	client *redis.Client
+}
+
+// allow counts the request in Redis.
+func (l *redisRateLimiter) allow(ctx context.Context, key string, rule RateLimitRule) (rateLimitResult, error) {
+	now := time.Now()
+	window := now.UnixNano() / int64(rule.Window)
+	current := fmt.Sprintf("ratelimit:%s:%d", key, window)
+	previous := fmt.Sprintf("ratelimit:%s:%d", key, window-1)
+	var incr *redis.IntCmd
+	var prev *redis.StringCmd
+	_, err := l.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		incr = pipe.Incr(ctx, current)
+		pipe.Expire(ctx, current, 2*rule.Window)
+		prev = pipe.Get(ctx, previous)
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return rateLimitResult{}, err
+	}
+	previousCount, _ := prev.Int64()
+	return slidingWindow(rule, now, incr.Val(), previousCount), nil
+}
+
+// memoryRateLimiter keeps the window counters in process. It stands in while Redis is unreachable.
+type memoryRateLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*memoryWindow
+	nextSweep time.Time
+}
+
+// memoryWindow holds the counts of the current and previous window of one key.
+type memoryWindow struct {
+	index    int64
+	current  int64
+	previous int64
+	expires  time.Time // once the current window is no longer needed
+}
+
+// allow counts the request in memory.
+func (l *memoryRateLimiter) allow(ctx context.Context, key string, rule RateLimitRule) (rateLimitResult, error) {
+	now := time.Now()
+	index := now.UnixNano() / int64(rule.Window)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.windows == nil {
+		l.windows = make(map[string]*memoryWindow)
+	}
+	if now.After(l.nextSweep) {
+		for k, w := range l.windows {
+			if now.After(w.expires) {
+				delete(l.windows, k)
+			}
+		}
+		l.nextSweep = now.Add(time.Minute)
+	}
+	w, ok := l.windows[key]
+	switch {
+	case !ok || index > w.index+1:
+		w = &memoryWindow{index: index}
+		l.windows[key] = w
+	case index == w.index+1:
+		w.index, w.previous, w.current = index, w.current, 0
+	}
+	w.current++
+	w.expires = now.Add(2 * rule.Window)
+	return slidingWindow(rule, now, w.current, w.previous), nil
+}
+
+// fallbackRateLimiter uses the primary limiter and switches to the fallback while the primary fails.
+// After a failure the primary is only tried again every fallbackRetry, so an unreachable Redis
+// does not add a connection timeout to every request.
+type fallbackRateLimiter struct {
+	primary  rateLimiter
+	fallback rateLimiter
+	failing  atomic.Bool
+	retryAt  atomic.Int64 // Unix nanoseconds
+}
+
+// fallbackRetry is how long the fallback limiter is used before the primary is tried again.
+const fallbackRetry = 5 * time.Second
+
+// allow counts the request with the primary limiter, or with the fallback if the primary errors.
+func (l *fallbackRateLimiter) allow(ctx context.Context, key string, rule RateLimitRule) (rateLimitResult, error) {
+	if l.failing.Load() && time.Now().UnixNano() < l.retryAt.Load() {
+		return l.fallback.allow(ctx, key, rule)
+	}
+	result, err := l.primary.allow(ctx, key, rule)
+	if err == nil {
+		if l.failing.Swap(false) {
+			log.Printf("rate limiter: redis is back, using shared limits again")
+		}
+		return result, nil
+	}
+	l.retryAt.Store(time.Now().Add(fallbackRetry).UnixNano())
+	if !l.failing.Swap(true) {
+		log.Printf("rate limiter: redis unreachable, falling back to in-process limits: %v", err)
+	}
+	return l.fallback.allow(ctx, key, rule)
+}
+
+// newRateLimiter returns a Redis-backed limiter with an in-process fallback.
+func newRateLimiter(client *redis.Client) rateLimiter {
+	return &fallbackRateLimiter{
+		primary:  &redisRateLimiter{client: client},
+		fallback: &memoryRateLimiter{},
+	}
+}
+
+// rule returns the rule for a route, keyed by method and route template.
+func (cfg RateLimitConfig) rule(method, template string) RateLimitRule {
+	if rule, ok := cfg.Routes[method+" "+template]; ok {
+		return rule
+	}
+	return cfg.Default
+}
+
+// rateLimitSubject returns who the request is counted for: the account of a valid access token,
+// or else the client IP. Only the signature is checked, the account is not loaded.
+func (s *APIServer) rateLimitSubject(r *http.Request) string {
+	if raw, _ := tokenFromRequest(r, s.auth); raw != "" {
+		if token, err := validateToken(raw, s.auth); err == nil {
+			if subject, err := token.Claims.(jwt.MapClaims).GetSubject(); err == nil && subject != "" {
+				return "account:" + subject
+			}
+		}
+	}
+	return "ip:" + clientIP(r, s.trustProxy)
+}
+
+// rateLimit is a middleware that counts requests per route and subject and answers 429 past the limit.
+// It sets the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers on every limited response.
+func (s *APIServer) rateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		template := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if t, err := route.GetPathTemplate(); err == nil {
+				template = t
+			}
+		}
+		rule := s.rateLimits.rule(r.Method, template)
+		if !s.rateLimits.Enabled || rule.Requests <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		key := r.Method + " " + template + ":" + s.rateLimitSubject(r)
+		result, err := s.limiter.allow(r.Context(), key, rule)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		reset := strconv.Itoa(int(math.Ceil(result.reset.Seconds())))
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(rule.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.remaining))
+		w.Header().Set("RateLimit-Reset", reset)
+		w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, int(rule.Window.Seconds())))
+		if !result.allowed {
+			writeError(w, r, tooManyRequests(result.reset, "rate limit exceeded, try again later"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
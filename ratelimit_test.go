@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSlidingWindow(t *testing.T) {
+	rule := RateLimitRule{Requests: 10, Window: time.Minute}
+	start := time.Unix(0, 0).Add(time.Hour)
+	tests := []struct {
+		name              string
+		elapsed           time.Duration
+		current, previous int64
+		allowed           bool
+		remaining         int
+	}{
+		{"empty windows", 0, 1, 0, true, 9},
+		{"previous window fully weighted", 0, 1, 10, false, 0},
+		{"previous window half weighted", 30 * time.Second, 1, 10, true, 4},
+		{"previous window mostly expired", 54 * time.Second, 9, 10, true, 0},
+		{"current window full", 59 * time.Second, 11, 0, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := slidingWindow(rule, start.Add(tt.elapsed), tt.current, tt.previous)
+			if got.allowed != tt.allowed || got.remaining != tt.remaining {
+				t.Fatalf("got allowed=%v remaining=%d, want allowed=%v remaining=%d", got.allowed, got.remaining, tt.allowed, tt.remaining)
+			}
+			if want := rule.Window - tt.elapsed; got.reset != want {
+				t.Fatalf("reset = %s, want %s", got.reset, want)
+			}
+		})
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) {
+		cfg.RateLimit.Routes["GET /tags"] = RateLimitRule{Requests: 2, Window: time.Hour}
+	})
+	for i := 0; i < 2; i++ {
+		rec := env.do("GET", "/tags", "", nil)
+		expectStatus(t, rec, http.StatusOK)
+		if rec.Header().Get("RateLimit-Limit") != "2" || rec.Header().Get("RateLimit-Policy") != "2;w=3600" {
+			t.Fatalf("rate limit headers = %v", rec.Header())
+		}
+	}
+	rec := env.do("GET", "/tags", "", nil)
+	expectStatus(t, rec, http.StatusTooManyRequests)
+	if rec.Header().Get("Retry-After") == "" || rec.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("rate limit headers = %v", rec.Header())
+	}
+
+	// Other routes are counted separately
+	expectStatus(t, env.do("GET", "/categories", "", nil), http.StatusOK)
+}
+
+func TestRateLimitFallsBackWithoutRedis(t *testing.T) {
+	env := newTestEnv(t, func(cfg *Config) {
+		cfg.RateLimit.Routes["GET /tags"] = RateLimitRule{Requests: 2, Window: time.Hour}
+	})
+	env.redis.Close()
+	for i := 0; i < 2; i++ {
+		expectStatus(t, env.do("GET", "/tags", "", nil), http.StatusOK)
+	}
+	expectStatus(t, env.do("GET", "/tags", "", nil), http.StatusTooManyRequests)
+}
@@ -2,40 +2,81 @@ package main
 
 import (
 	"context"
-	"log"
-	"net/http"
+	"time"
 
+	jwt "github.com/golang-jwt/jwt/v5"
 	redis "github.com/redis/go-redis/v9"
 )
 
-// NewRedisDB creates a new Redis client.
-func NewRedisDB() *redis.Client {
+// NewRedisDB creates a new Redis client, retrying the first connection for cfg.ConnectTimeout.
+func NewRedisDB(cfg RedisConfig) (*redis.Client, error) {
 	client := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password set
-		DB:       0,  // use default DB
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	err := retryWithBackoff("Redis", cfg.ConnectTimeout, func(ctx context.Context) error {
+		return client.Ping(ctx).Err()
 	})
-	_, err := client.Ping(context.Background()).Result()
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// revokedTokenKey returns the Redis key marking the access token with the given jti as revoked.
+func revokedTokenKey(jti string) string {
+	return "revoked:jti:" + jti
+}
+
+// revokeToken revokes a single access token. The marker expires together with the token.
+func revokeToken(ctx context.Context, client *redis.Client, claims jwt.MapClaims) error {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return unauthorized("token has no jti")
+	}
+	exp, err := claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return unauthorized("token has no expiry")
 	}
-	return client
+	ttl := time.Until(exp.Time)
+	if ttl <= 0 {
+		return nil
+	}
+	return client.Set(ctx, revokedTokenKey(jti), 1, ttl).Err()
 }
 
-// isBlacklistedToken checks if the provided token is blacklisted in Redis.
-func isBlacklistedToken(w http.ResponseWriter, r *http.Request, s *redis.Client) bool {
-	// Check if token is blacklisted
-	token := r.Header.Get("token")
+// isBlacklistedToken reports whether the access token with the given claims was revoked.
+// Tokens without a jti cannot be revoked one by one and are refused.
+func isBlacklistedToken(ctx context.Context, client *redis.Client, claims jwt.MapClaims) (bool, error) {
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return true, nil
+	}
+	n, err := client.Exists(ctx, revokedTokenKey(jti)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
 
-	isBlacklisted, err := s.Exists(context.Background(), token).Result()
+// revokeAccountTokens bumps the token version of the account, which invalidates every access token
+// issued to it so far, and revokes all of its refresh tokens. It returns the new token version.
+func (s *APIServer) revokeAccountTokens(ctx context.Context, accountID int) (int, error) {
+	version, err := s.dbStore.BumpTokenVersion(accountID)
 	if err != nil {
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return true
+		return 0, err
 	}
+	return version, revokeAccountRefreshTokens(ctx, s.redisClient, accountID)
+}
 
-	if isBlacklisted == 1 {
-		http.Error(w, "Blacklisted token", http.StatusUnauthorized)
-		return true
+// setPassword stores a new password hash with a bumped token version and revokes all refresh tokens
+// of the account, so only sessions started with the new password remain. It returns the new token version.
+func (s *APIServer) setPassword(ctx context.Context, accountID int, hash string) (int, error) {
+	version, err := s.dbStore.SetPassword(accountID, hash)
+	if err != nil {
+		return 0, err
 	}
-	return false
+	return version, revokeAccountRefreshTokens(ctx, s.redisClient, accountID)
 }
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	login := env.login("alice", "passw0rd1")
+
+	expectStatus(t, env.do("POST", "/logout", login.Token, nil), http.StatusOK)
+	expectStatus(t, env.do("GET", "/me", login.Token, nil), http.StatusUnauthorized)
+
+	// Other sessions are not affected
+	expectStatus(t, env.do("GET", "/me", env.login("alice", "passw0rd1").Token, nil), http.StatusOK)
+}
+
+func TestRevokeAllAccountTokens(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createAccount("alice", "passw0rd1", roleUser)
+	env.createAccount("admin", "passw0rd1", roleAdmin)
+	adminToken := env.login("admin", "passw0rd1").Token
+	first, second := env.login("alice", "passw0rd1"), env.login("alice", "passw0rd1")
+	path := "/account/" + strconv.Itoa(alice.ID) + "/tokens"
+
+	expectStatus(t, env.do("DELETE", path, first.Token, nil), http.StatusForbidden)
+	expectStatus(t, env.do("DELETE", path, adminToken, nil), http.StatusNoContent)
+	for _, session := range []LoginResponse{first, second} {
+		expectStatus(t, env.do("GET", "/me", session.Token, nil), http.StatusUnauthorized)
+		expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: session.RefreshToken}), http.StatusUnauthorized)
+	}
+	expectStatus(t, env.do("GET", "/me", env.login("alice", "passw0rd1").Token, nil), http.StatusOK)
+	expectStatus(t, env.do("DELETE", "/account/999/tokens", adminToken, nil), http.StatusNotFound)
+}
+
+func TestConcurrentUpdateDoesNotUndoRevocation(t *testing.T) {
+	env := newTestEnv(t)
+	alice := env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+
+	// An update that read the account before the revocation writes its copy back afterwards
+	stale, err := env.store.GetAccountByID(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := env.server.revokeAccountTokens(context.Background(), alice.ID); err != nil {
+		t.Fatal(err)
+	}
+	stale.Country = "DE"
+	if err := env.store.UpdateAccount(stale); err != nil {
+		t.Fatal(err)
+	}
+	expectStatus(t, env.do("GET", "/me", token, nil), http.StatusUnauthorized)
+}
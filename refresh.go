@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// refreshRecord is the value stored in Redis for each issued refresh token.
+type refreshRecord struct {
+	AccountID int    `json:"accountId"`
+	Family    string `json:"family"`
+}
+
+// refreshTokenKey returns the Redis key of a refresh token. Only the token hash is stored.
+func refreshTokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "refresh:token:" + hex.EncodeToString(sum[:])
+}
+
+// refreshUsedKey returns the Redis key marking a refresh token as already rotated.
+func refreshUsedKey(token string) string {
+	return refreshTokenKey(token) + ":used"
+}
+
+// refreshFamilyKey returns the Redis key of a refresh token family.
+// All tokens rotated from the same login share a family.
+func refreshFamilyKey(family string) string {
+	return "refresh:family:" + family
+}
+
+// refreshAccountKey returns the Redis key of the set of token families issued to an account.
+func refreshAccountKey(accountID int) string {
+	return fmt.Sprintf("refresh:account:%d", accountID)
+}
+
+// randomToken returns a URL-safe random string of n bytes of entropy.
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// issueRefreshToken creates a new refresh token for the account.
+// An empty family starts a new token family. The token expires after ttl.
+func issueRefreshToken(ctx context.Context, client *redis.Client, ttl time.Duration, accountID int, family string) (string, error) {
+	if family == "" {
+		var err error
+		if family, err = randomToken(16); err != nil {
+			return "", err
+		}
+	}
+	token, err := randomToken(32)
+	if err != nil {
+		return "", err
+	}
+	record, err := json.Marshal(refreshRecord{AccountID: accountID, Family: family})
+	if err != nil {
+		return "", err
+	}
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, refreshFamilyKey(family), accountID, ttl)
+		pipe.Set(ctx, refreshTokenKey(token), record, ttl)
+		pipe.SAdd(ctx, refreshAccountKey(accountID), family)
+		pipe.Expire(ctx, refreshAccountKey(accountID), ttl)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// lookupRefreshToken returns the stored record of a refresh token.
+func lookupRefreshToken(ctx context.Context, client *redis.Client, token string) (*refreshRecord, error) {
+	data, err := client.Get(ctx, refreshTokenKey(token)).Bytes()
+	if err == redis.Nil {
+		return nil, unauthorized("invalid refresh token")
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := new(refreshRecord)
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// rotateRefreshToken consumes a refresh token and issues its successor in the same family.
+// Presenting a token that was already rotated revokes the whole family.
+func rotateRefreshToken(ctx context.Context, client *redis.Client, ttl time.Duration, token string) (*refreshRecord, string, error) {
+	record, err := lookupRefreshToken(ctx, client, token)
+	if err != nil {
+		return nil, "", err
+	}
+	first, err := client.SetNX(ctx, refreshUsedKey(token), 1, ttl).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if !first {
+		if err := client.Del(ctx, refreshFamilyKey(record.Family)).Err(); err != nil {
+			return nil, "", err
+		}
+		return nil, "", unauthorized("refresh token reuse detected, please log in again")
+	}
+	active, err := client.Exists(ctx, refreshFamilyKey(record.Family)).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	if active == 0 {
+		return nil, "", unauthorized("refresh token has been revoked")
+	}
+	next, err := issueRefreshToken(ctx, client, ttl, record.AccountID, record.Family)
+	if err != nil {
+		return nil, "", err
+	}
+	return record, next, nil
+}
+
+// revokeRefreshToken revokes the family the given refresh token belongs to.
+func revokeRefreshToken(ctx context.Context, client *redis.Client, token string) error {
+	record, err := lookupRefreshToken(ctx, client, token)
+	if err != nil {
+		return err
+	}
+	return client.Del(ctx, refreshFamilyKey(record.Family)).Err()
+}
+
+// revokeAccountRefreshTokens revokes every refresh token family issued to the account.
+func revokeAccountRefreshTokens(ctx context.Context, client *redis.Client, accountID int) error {
+	families, err := client.SMembers(ctx, refreshAccountKey(accountID)).Result()
+	if err != nil {
+		return err
+	}
+	keys := []string{refreshAccountKey(accountID)}
+	for _, family := range families {
+		keys = append(keys, refreshFamilyKey(family))
+	}
+	return client.Del(ctx, keys...).Err()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestRefreshTokenRotation(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	first := env.login("alice", "passw0rd1")
+
+	rec := env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken})
+	expectStatus(t, rec, http.StatusOK)
+	second := decodeBody[LoginResponse](t, rec)
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token was not rotated: %q", second.RefreshToken)
+	}
+	expectStatus(t, env.do("GET", "/me", second.Token, nil), http.StatusOK)
+
+	rec = env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: second.RefreshToken})
+	expectStatus(t, rec, http.StatusOK)
+	third := decodeBody[LoginResponse](t, rec)
+
+	// Replaying a rotated token revokes the whole family, including the newest token
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: first.RefreshToken}), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: third.RefreshToken}), http.StatusUnauthorized)
+
+	// Other sessions keep working
+	other := env.login("alice", "passw0rd1")
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: other.RefreshToken}), http.StatusOK)
+}
+
+func TestRefreshTokenRejectsUnknownToken(t *testing.T) {
+	env := newTestEnv(t)
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{RefreshToken: "unknown"}), http.StatusUnauthorized)
+	expectStatus(t, env.do("POST", "/token/refresh", "", RefreshRequest{}), http.StatusBadRequest)
+}
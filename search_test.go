@@ -0,0 +1,43 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestMarkSnippet(t *testing.T) {
+	got := markSnippet(`<img src=x onerror=alert(1)> ` + snippetStart + "golang" + snippetStop + ` & "more"`)
+	want := `&lt;img src=x onerror=alert(1)&gt; <mark>golang</mark> &amp; &#34;more&#34;`
+	if got != want {
+		t.Fatalf("markSnippet = %s, want %s", got, want)
+	}
+}
+
+func TestSearchPostsEscapesSnippets(t *testing.T) {
+	env := newTestEnv(t)
+	env.createAccount("alice", "passw0rd1", roleUser)
+	token := env.login("alice", "passw0rd1").Token
+	for _, post := range []PostRequest{
+		{Title: "Learning golang", Body: "Start with the tour.", Status: postPublished},
+		{Title: "Notes", Body: "<img src=x onerror=alert(1)> golang", Status: postPublished},
+		{Title: "Golang draft", Body: "Not published yet."},
+	} {
+		expectStatus(t, env.do("POST", "/posts", token, post), http.StatusOK)
+	}
+
+	rec := env.do("GET", "/search?q=golang", "", nil)
+	expectStatus(t, rec, http.StatusOK)
+	results := decodeBody[[]*SearchResult](t, rec)
+	if len(results) != 2 {
+		t.Fatalf("got %d results, want the 2 published posts", len(results))
+	}
+	// Title matches rank above body matches
+	if results[0].Post.Title != "Learning golang" || results[1].Post.Title != "Notes" {
+		t.Fatalf("results in wrong order: %s, %s", results[0].Post.Title, results[1].Post.Title)
+	}
+	if want := "&lt;img src=x onerror=alert(1)&gt; <mark>golang</mark>"; results[1].Snippet != want {
+		t.Fatalf("snippet = %s, want %s", results[1].Snippet, want)
+	}
+
+	expectStatus(t, env.do("GET", "/search", "", nil), http.StatusBadRequest)
+}
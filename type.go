@@ -1,32 +1,127 @@
 package main
 
 import (
+	"errors"
+	"sort"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
+const (
+	roleAdmin = 1 // id of the seeded 'admin' role
+	roleUser  = 2 // id of the seeded 'user' role
+)
+
+// Permissions that can be granted to a role through the role_permission table.
+const (
+	permListAccounts  = "account:list"        // list every account
+	permManageAccount = "account:manage"      // read, update or delete any account
+	permAssignRole    = "account:assign-role" // choose the role of a new account
+	permWritePost     = "post:write"          // create posts and edit one's own
+	permManagePost    = "post:manage"         // edit or delete any post
+	permManageTerms   = "category:manage"     // create categories
+)
+
+// Post statuses. Only published posts are visible to everyone.
+const (
+	postDraft     = "draft"
+	postPublished = "published"
+)
+
+// Role represents a role together with the permissions granted to it.
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// HasPermission reports whether the role grants the given permission.
+func (role *Role) HasPermission(permission string) bool {
+	for _, p := range role.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
 // LoginRequest represents the structure of a login request.
 type LoginRequest struct {
-	UserName string `json:"username"`
-	Password string `json:"password"`
+	UserName string `json:"username" validate:"required,max=255"`
+	Password string `json:"password" validate:"required,max=72"`
 }
 
 // LoginResponse represents the structure of a login response.
 type LoginResponse struct {
-	Token    string `json:"token"`
-	UserName string `json:"userName"`
+	Token        string `json:"token,omitempty"`
+	RefreshToken string `json:"refreshToken"`
+	UserName     string `json:"userName"`
+	CSRFToken    string `json:"csrfToken,omitempty"` // only in cookie mode
+}
+
+// MeResponse is the caller's own account together with what its role allows.
+type MeResponse struct {
+	*Account
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions"`
+}
+
+// RefreshRequest represents the structure of a token refresh request.
+type RefreshRequest struct {
+	RefreshToken string `json:"refreshToken" validate:"required"`
 }
 
 // AccountRequest represents the structure of an account creation request.
 type AccountRequest struct {
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
-	Email     string `json:"email"`
-	Username  string `json:"username"`
-	Password  string `json:"password"`
-	RoleId    int    `json:"roleId"`
-	Country   string `json:"country"`
+	FirstName string `json:"firstName" validate:"required,max=255"`
+	LastName  string `json:"lastName" validate:"required,max=255"`
+	Email     string `json:"email" validate:"required,max=255,email"`
+	Username  string `json:"username" validate:"required,min=3,max=50,username"`
+	Password  string `json:"password" validate:"required,password"`
+	RoleId    int    `json:"roleId" validate:"min=0"`
+	Country   string `json:"country" validate:"required,country"`
+}
+
+// ResendVerificationRequest represents the structure of a request to resend the verification e-mail.
+type ResendVerificationRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ForgotPasswordRequest represents the structure of a request to mail a password reset link.
+type ForgotPasswordRequest struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+// ResetPasswordRequest represents the structure of a request to set a new password with a reset token.
+type ResetPasswordRequest struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,password"`
+}
+
+// ChangePasswordRequest represents the structure of a request to change the caller's own password.
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"currentPassword" validate:"required"`
+	NewPassword     string `json:"newPassword" validate:"required,password"`
+}
+
+// Validate rejects a new password that equals the current one.
+func (req *ChangePasswordRequest) Validate() []FieldError {
+	if req.NewPassword != "" && req.NewPassword == req.CurrentPassword {
+		return []FieldError{{Field: "newPassword", Message: "must differ from the current password"}}
+	}
+	return nil
+}
+
+// UpdateAccountRequest represents the structure of a partial account update request.
+// Fields left out of the JSON body are not changed.
+type UpdateAccountRequest struct {
+	FirstName *string `json:"firstName,omitempty" validate:"notblank,max=255"`
+	LastName  *string `json:"lastName,omitempty" validate:"notblank,max=255"`
+	Email     *string `json:"email,omitempty" validate:"notblank,max=255,email"`
+	Password  *string `json:"password,omitempty" validate:"notblank,password"`
+	Country   *string `json:"country,omitempty" validate:"notblank,country"`
 }
 
 // Account represents the structure of an account.
@@ -36,15 +131,17 @@ type Account struct {
 	LastName          string    `json:"lastName"`
 	Email             string    `json:"email"`
 	Username          string    `json:"username"`
-	EncryptedPassword string    `json:"-"`
+	EncryptedPassword string    `json:"-"` // empty when served from the account cache
 	Country           string    `json:"country"`
 	RoleID            int       `json:"-"`
 	CreatedAt         time.Time `json:"createdAt"`
+	EmailVerified     bool      `json:"emailVerified"`
+	TokenVersion      int       `json:"-"`
 }
 
 // NewAccount creates a new account with the provided details.
 func NewAccount(firstname, lastname, email, username, password, country string, roleId int) (*Account, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hash, err := hashPassword(password)
 	if err != nil {
 		return nil, err
 	}
@@ -53,13 +150,257 @@ func NewAccount(firstname, lastname, email, username, password, country string,
 		LastName:          lastname,
 		Email:             email,
 		Username:          username,
-		EncryptedPassword: string(hash),
+		EncryptedPassword: hash,
 		Country:           country,
 		RoleID:            roleId,
 		CreatedAt:         time.Now().UTC(),
 	}, nil
 }
 
+// maxPasswordBytes is the longest password bcrypt accepts.
+const maxPasswordBytes = 72
+
+// hashPassword returns the bcrypt hash of the given password.
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if errors.Is(err, bcrypt.ErrPasswordTooLong) {
+		return "", invalid("password must be at most %d bytes", maxPasswordBytes)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Apply copies the provided fields onto the account. The request must have been validated.
+// The password is not copied; it is hashed and stored apart, see handleUpdateAccount.
+func (req *UpdateAccountRequest) Apply(account *Account) {
+	if req.FirstName != nil {
+		account.FirstName = *req.FirstName
+	}
+	if req.LastName != nil {
+		account.LastName = *req.LastName
+	}
+	if req.Email != nil {
+		if !strings.EqualFold(account.Email, *req.Email) {
+			// A new address has to be verified again
+			account.EmailVerified = false
+		}
+		account.Email = *req.Email
+	}
+	if req.Country != nil {
+		account.Country = *req.Country
+	}
+}
+
+// Post represents a learning-material post written in markdown.
+type Post struct {
+	ID         int       `json:"id"`
+	AuthorID   int       `json:"authorId"`
+	Title      string    `json:"title"`
+	Slug       string    `json:"slug"`
+	Body       string    `json:"body"`
+	Status     string    `json:"status"`
+	Tags       []string  `json:"tags"`
+	Categories []string  `json:"categories"`
+	CreatedAt  time.Time `json:"createdAt"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
+// PostRequest represents the structure of a post creation request.
+// Categories are given by slug and must already exist; unknown tags are created.
+type PostRequest struct {
+	Title      string   `json:"title" validate:"required,max=255"`
+	Slug       string   `json:"slug" validate:"max=255"`
+	Body       string   `json:"body"`
+	Status     string   `json:"status" validate:"oneof=draft|published"`
+	Tags       []string `json:"tags" validate:"max=100"`
+	Categories []string `json:"categories" validate:"max=100"`
+}
+
+// UpdatePostRequest represents the structure of a partial post update request.
+// Fields left out of the JSON body are not changed.
+type UpdatePostRequest struct {
+	Title      *string   `json:"title,omitempty" validate:"notblank,max=255"`
+	Slug       *string   `json:"slug,omitempty" validate:"max=255"`
+	Body       *string   `json:"body,omitempty"`
+	Status     *string   `json:"status,omitempty" validate:"oneof=draft|published"`
+	Tags       *[]string `json:"tags,omitempty" validate:"max=100"`
+	Categories *[]string `json:"categories,omitempty" validate:"max=100"`
+}
+
+// PostQuery selects which posts ListPosts returns. Zero values do not filter.
+type PostQuery struct {
+	Status   string
+	AuthorID int
+	Tag      string // normalized tag, see normalizeTags
+	Category string // category slug, subcategories included
+}
+
+// SearchResult represents a post matching a search with its rank and a highlighted snippet.
+type SearchResult struct {
+	Post    *Post   `json:"post"`
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"` // escaped HTML, matches wrapped in <mark>
+}
+
+// TagCount represents a tag and the number of published posts carrying it.
+type TagCount struct {
+	Name      string `json:"name"`
+	PostCount int    `json:"postCount"`
+}
+
+// Category represents a topic that posts can be filed under. Categories form a tree.
+type Category struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Slug     string `json:"slug"`
+	ParentID *int   `json:"parentId"`
+}
+
+// CategoryRequest represents the structure of a category creation request.
+type CategoryRequest struct {
+	Name     string `json:"name" validate:"required,max=100"`
+	Slug     string `json:"slug" validate:"max=100"`
+	ParentID *int   `json:"parentId"`
+}
+
+// NewPost creates a new post by the given author from the request.
+// The slug is derived from the title when the request does not set one.
+func NewPost(authorID int, req *PostRequest) (*Post, error) {
+	if strings.TrimSpace(req.Title) == "" {
+		return nil, invalidField("title", "must not be empty")
+	}
+	if req.Status == "" {
+		req.Status = postDraft
+	}
+	if !validPostStatus(req.Status) {
+		return nil, invalidField("status", "invalid status %q", req.Status)
+	}
+	if req.Slug == "" {
+		req.Slug = slugify(req.Title)
+	}
+	if !validSlug(req.Slug) {
+		return nil, invalidField("slug", "invalid slug %q", req.Slug)
+	}
+	tags, err := normalizeTags(req.Tags)
+	if err != nil {
+		return nil, err
+	}
+	categories, err := normalizeCategories(req.Categories)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().UTC()
+	return &Post{
+		AuthorID:   authorID,
+		Title:      req.Title,
+		Slug:       req.Slug,
+		Body:       req.Body,
+		Status:     req.Status,
+		Tags:       tags,
+		Categories: categories,
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}, nil
+}
+
+// Apply validates the request and copies the provided fields onto the post.
+func (req *UpdatePostRequest) Apply(post *Post) error {
+	if req.Title != nil {
+		if strings.TrimSpace(*req.Title) == "" {
+			return invalidField("title", "must not be empty")
+		}
+		post.Title = *req.Title
+	}
+	if req.Slug != nil {
+		if !validSlug(*req.Slug) {
+			return invalidField("slug", "invalid slug %q", *req.Slug)
+		}
+		post.Slug = *req.Slug
+	}
+	if req.Body != nil {
+		post.Body = *req.Body
+	}
+	if req.Status != nil {
+		if !validPostStatus(*req.Status) {
+			return invalidField("status", "invalid status %q", *req.Status)
+		}
+		post.Status = *req.Status
+	}
+	if req.Tags != nil {
+		tags, err := normalizeTags(*req.Tags)
+		if err != nil {
+			return err
+		}
+		post.Tags = tags
+	}
+	if req.Categories != nil {
+		categories, err := normalizeCategories(*req.Categories)
+		if err != nil {
+			return err
+		}
+		post.Categories = categories
+	}
+	post.UpdatedAt = time.Now().UTC()
+	return nil
+}
+
+// normalizeTags slugifies and de-duplicates tag names.
+func normalizeTags(names []string) ([]string, error) {
+	tags := []string{}
+	seen := map[string]bool{}
+	for _, name := range names {
+		tag := slugify(name)
+		if tag == "" {
+			return nil, invalidField("tags", "invalid tag %q", name)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	sort.Strings(tags)
+	return tags, nil
+}
+
+// normalizeCategories validates and de-duplicates category slugs.
+func normalizeCategories(slugs []string) ([]string, error) {
+	categories := []string{}
+	seen := map[string]bool{}
+	for _, slug := range slugs {
+		if !validSlug(slug) {
+			return nil, invalidField("categories", "invalid category %q", slug)
+		}
+		if !seen[slug] {
+			seen[slug] = true
+			categories = append(categories, slug)
+		}
+	}
+	sort.Strings(categories)
+	return categories, nil
+}
+
+// NewCategory creates a new category from the request.
+// The slug is derived from the name when the request does not set one.
+func NewCategory(req *CategoryRequest) (*Category, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return nil, invalidField("name", "must not be empty")
+	}
+	if req.Slug == "" {
+		req.Slug = slugify(req.Name)
+	}
+	if !validSlug(req.Slug) {
+		return nil, invalidField("slug", "invalid slug %q", req.Slug)
+	}
+	return &Category{Name: req.Name, Slug: req.Slug, ParentID: req.ParentID}, nil
+}
+
+// validPostStatus reports whether status is a known post status.
+func validPostStatus(status string) bool {
+	return status == postDraft || status == postPublished
+}
+
 // ValidPassword checks if the provided password matches the account's encrypted password.
 func (account *Account) ValidPassword(password string) bool {
 	return bcrypt.CompareHashAndPassword([]byte(account.EncryptedPassword), []byte(password)) == nil
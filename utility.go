@@ -1,20 +1,40 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
+	"github.com/lib/pq"
+	"html"
+	"net"
 	"net/http"
 	"strconv"
+	"strings"
 )
 
+// clientIP returns the IP address of the client. With trustProxy the first X-Forwarded-For entry is used.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 // getID extracts an integer ID from the request URL parameters.
 func getID(r *http.Request) (int, error) {
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return id, fmt.Errorf("invalid id given %s", idStr)
+		return id, invalidField("id", "invalid id given %s", idStr)
 	}
 	return id, nil
 }
@@ -31,49 +51,230 @@ func scanIntoAccount(rows *sql.Rows) (*Account, error) {
 		&account.EncryptedPassword,
 		&account.Country,
 		&account.RoleID,
-		&account.CreatedAt)
+		&account.CreatedAt,
+		&account.EmailVerified,
+		&account.TokenVersion)
 	return account, err
 }
 
-// isAuthenticated is a middleware function to check if the user is authenticated.
+// scanIntoPost scans rows from a SQL result into a Post struct.
+func scanIntoPost(rows *sql.Rows) (*Post, error) {
+	post := new(Post)
+	err := rows.Scan(
+		&post.ID,
+		&post.AuthorID,
+		&post.Title,
+		&post.Slug,
+		&post.Body,
+		&post.Status,
+		&post.CreatedAt,
+		&post.UpdatedAt,
+		pq.Array(&post.Tags),
+		pq.Array(&post.Categories))
+	return post, err
+}
+
+// scanIntoSearchResult scans rows from a SQL result into a SearchResult struct.
+// The post columns are followed by the rank and the snippet.
+func scanIntoSearchResult(rows *sql.Rows) (*SearchResult, error) {
+	result := &SearchResult{Post: new(Post)}
+	post := result.Post
+	err := rows.Scan(
+		&post.ID,
+		&post.AuthorID,
+		&post.Title,
+		&post.Slug,
+		&post.Body,
+		&post.Status,
+		&post.CreatedAt,
+		&post.UpdatedAt,
+		pq.Array(&post.Tags),
+		pq.Array(&post.Categories),
+		&result.Rank,
+		&result.Snippet)
+	return result, err
+}
+
+// slugify turns a title into a lowercase, dash separated URL slug.
+func slugify(title string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(title) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+	}
+	return strings.TrimSuffix(b.String(), "-")
+}
+
+// Search snippets come back with their matches between these control characters. markSnippet swaps them
+// for <mark> tags once the rest of the text has been escaped, so post bodies never reach clients as HTML.
+const (
+	snippetStart = "\x02"
+	snippetStop  = "\x03"
+)
+
+// snippetMarks turns the snippet delimiters into <mark> tags.
+var snippetMarks = strings.NewReplacer(snippetStart, "<mark>", snippetStop, "</mark>")
+
+// markSnippet escapes a search snippet as HTML and wraps its matches in <mark> tags.
+func markSnippet(snippet string) string {
+	return snippetMarks.Replace(html.EscapeString(snippet))
+}
+
+// validSlug reports whether slug only holds lowercase letters, digits and single dashes.
+func validSlug(slug string) bool {
+	return slug != "" && slug == slugify(slug)
+}
+
+// principalKey is the context key of the account that authenticated the request.
+type principalKey struct{}
+
+// withPrincipal returns a copy of the request carrying the authenticated account in its context.
+func withPrincipal(r *http.Request, account *Account) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, account))
+}
+
+// principalFromContext returns the account stored by an authentication middleware, if any.
+func principalFromContext(ctx context.Context) (*Account, bool) {
+	account, ok := ctx.Value(principalKey{}).(*Account)
+	return account, ok
+}
+
+// isAuthenticated is a middleware function that only lets requests with a valid token through
+// and stores the account the token was issued to as the request's principal.
 func isAuthenticated(handlerFunc http.HandlerFunc, s *APIServer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("calling JWT auth middleware")
-		if isBlacklistedToken(w, r, s.redisClient) {
-			return
-		}
-		tokenFromHeader := r.Header.Get("token")
-		token, err := validateToken(tokenFromHeader)
+		caller, err := callerAccount(r, s)
 		if err != nil {
-			permissionDenied(w, "token not verified")
-			return
-		}
-		if !token.Valid {
-			permissionDenied(w, "token not valid")
+			writeError(w, r, err)
 			return
 		}
-		userID, err := getID(r)
+		handlerFunc(w, withPrincipal(r, caller))
+	}
+}
+
+// authorizeAccount allows the owner of the account and callers that may manage accounts to act on it.
+func authorizeAccount(r *http.Request, s *APIServer, accountID int) error {
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return err
+	}
+	if caller.ID == accountID || callerHasPermission(r, s, permManageAccount) {
+		return nil
+	}
+	return forbidden("not allowed to act on this account")
+}
+
+// callerAccount returns the account the request's token was issued to, taken from the context
+// when a middleware already authenticated the request.
+// The token must be valid and its role claim must still match the stored account.
+func callerAccount(r *http.Request, s *APIServer) (*Account, error) {
+	if account, ok := principalFromContext(r.Context()); ok {
+		return account, nil
+	}
+	raw, fromCookie := tokenFromRequest(r, s.auth)
+	if raw == "" {
+		return nil, unauthorized("missing access token")
+	}
+	token, err := validateToken(raw, s.auth)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, unauthorized("token not valid")
+	}
+	if fromCookie && !validCSRF(r, s.auth, raw) {
+		return nil, forbidden("missing or invalid CSRF token")
+	}
+	claims := token.Claims.(jwt.MapClaims)
+	revoked, err := isBlacklistedToken(r.Context(), s.redisClient, claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		authBlacklistHits.Inc()
+		return nil, unauthorized("token has been revoked")
+	}
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return nil, unauthorized("token not valid")
+	}
+	accountID, err := strconv.Atoi(subject)
+	if err != nil {
+		return nil, unauthorized("token not valid")
+	}
+	role, ok := claims["role"].(float64)
+	if !ok {
+		return nil, unauthorized("token not valid")
+	}
+	account, err := s.dbStore.GetAccountByID(accountID)
+	var domainErr *DomainError
+	if errors.As(err, &domainErr) && domainErr.Kind == KindNotFound {
+		return nil, unauthorized("account no longer exists")
+	}
+	// Any other failure is ours, not the token's, so clients must not drop their session over it
+	if err != nil {
+		return nil, err
+	}
+	if account.RoleID != int(role) {
+		return nil, unauthorized("unauthorized")
+	}
+	// Tokens issued before the last password change carry an older version
+	version, _ := claims["ver"].(float64)
+	if account.TokenVersion != int(version) {
+		return nil, unauthorized("token has been revoked")
+	}
+	return account, nil
+}
+
+// callerHasPermission reports whether the caller's role grants the given permission.
+func callerHasPermission(r *http.Request, s *APIServer, permission string) bool {
+	caller, err := callerAccount(r, s)
+	if err != nil {
+		return false
+	}
+	role, err := s.dbStore.GetRole(caller.RoleID)
+	if err != nil {
+		return false
+	}
+	return role.HasPermission(permission)
+}
+
+// requirePermission is a middleware function that only lets callers whose role grants the permission through.
+func requirePermission(permission string, handlerFunc http.HandlerFunc, s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := callerAccount(r, s)
 		if err != nil {
-			permissionDenied(w, "error fetching id")
+			writeError(w, r, err)
 			return
 		}
-		account, err := s.dbStore.GetAccountByID(userID)
-		if err != nil {
-			permissionDenied(w, "error fetching account")
+		role, err := s.dbStore.GetRole(caller.RoleID)
+		if err != nil || !role.HasPermission(permission) {
+			writeError(w, r, forbidden("forbidden"))
 			return
 		}
+		handlerFunc(w, withPrincipal(r, caller))
+	}
+}
 
-		claims := token.Claims.(jwt.MapClaims)
-		if account.Username != claims["username"] || account.RoleID != int(claims["role"].(float64)) {
-			permissionDenied(w, "unauthorized")
+// requireRole is a middleware function that only lets callers holding the named role through.
+func requireRole(roleName string, handlerFunc http.HandlerFunc, s *APIServer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		caller, err := callerAccount(r, s)
+		if err != nil {
+			writeError(w, r, err)
 			return
 		}
-
-		if err != nil {
-			writeJSON(w, http.StatusForbidden, ApiError{Error: "invalid token"})
+		role, err := s.dbStore.GetRole(caller.RoleID)
+		if err != nil || role.Name != roleName {
+			writeError(w, r, forbidden("forbidden"))
 			return
 		}
-
-		handlerFunc(w, r)
+		handlerFunc(w, withPrincipal(r, caller))
 	}
 }
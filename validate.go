@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// requestValidator checks request structs against the rules in their `validate` struct tags.
+//
+// Rules are comma separated and run in order; the first failing rule is reported for the field:
+//
+//	required       the value must be present and not blank
+//	notblank       a present string must not be blank
+//	min=N, max=N   length of a string or value of an int
+//	email          a bare e-mail address
+//	username       letters, digits, '.', '_' and '-'
+//	password       the configured password policy, at most 72 bytes for bcrypt
+//	country        an ISO 3166-1 alpha-2 country code
+//	oneof=a|b      one of the listed values
+//
+// Nil pointer fields and empty optional strings are skipped, so partial update requests can share the rules.
+// An empty string behind a non-nil pointer was sent explicitly and is checked like any other value.
+// The rules of a slice field apply to each of its elements.
+// A struct may also implement Validate() []FieldError for checks that span several fields.
+type requestValidator struct {
+	passwordPolicy PasswordPolicy
+}
+
+// usernamePattern matches the characters allowed in a username.
+var usernamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// Struct validates v, a pointer to a struct, and returns every failing field in one validation error.
+func (rv *requestValidator) Struct(v interface{}) error {
+	value := reflect.Indirect(reflect.ValueOf(v))
+	if value.Kind() != reflect.Struct {
+		return nil
+	}
+	var fields []FieldError
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		rules := field.Tag.Get("validate")
+		if rules == "" {
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			name = field.Name
+		}
+		if message := rv.field(value.Field(i), rules); message != "" {
+			fields = append(fields, FieldError{Field: name, Message: message})
+		}
+	}
+	if checker, ok := v.(interface{ Validate() []FieldError }); ok {
+		fields = append(fields, checker.Validate()...)
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return &DomainError{Kind: KindValidation, Message: "request validation failed", Fields: fields}
+}
+
+// field applies the comma separated rules to a single field and returns the first failure.
+func (rv *requestValidator) field(value reflect.Value, rules string) string {
+	required := false
+	for _, rule := range strings.Split(rules, ",") {
+		if rule == "required" {
+			required = true
+		}
+	}
+	if value.Kind() == reflect.Pointer {
+		if value.IsNil() {
+			if required {
+				return "is required"
+			}
+			return ""
+		}
+		// A value sent through a pointer was given explicitly, so it is checked even when empty
+		value = value.Elem()
+	} else if value.Kind() == reflect.String && value.String() == "" && !required {
+		return ""
+	}
+	if value.Kind() == reflect.Slice {
+		for i := 0; i < value.Len(); i++ {
+			if message := rv.field(value.Index(i), rules); message != "" {
+				return fmt.Sprintf("entry %d %s", i+1, message)
+			}
+		}
+		return ""
+	}
+
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		if message := rv.rule(name, arg, value); message != "" {
+			return message
+		}
+	}
+	return ""
+}
+
+// rule applies a single named rule to the value and returns a message if it fails.
+func (rv *requestValidator) rule(name, arg string, value reflect.Value) string {
+	switch name {
+	case "required":
+		if value.Kind() == reflect.String && strings.TrimSpace(value.String()) == "" {
+			return "is required"
+		}
+		if value.IsZero() {
+			return "is required"
+		}
+	case "notblank":
+		if strings.TrimSpace(value.String()) == "" {
+			return "must not be blank"
+		}
+	case "min", "max":
+		limit, err := strconv.Atoi(arg)
+		if err != nil {
+			panic(fmt.Sprintf("validate: bad %s argument %q", name, arg))
+		}
+		n, unit := 0, ""
+		switch value.Kind() {
+		case reflect.String:
+			n, unit = utf8.RuneCountInString(value.String()), " characters"
+		case reflect.Int:
+			n = int(value.Int())
+		}
+		if name == "min" && n < limit {
+			return fmt.Sprintf("must be at least %d%s", limit, unit)
+		}
+		if name == "max" && n > limit {
+			return fmt.Sprintf("must be at most %d%s", limit, unit)
+		}
+	case "email":
+		addr, err := mail.ParseAddress(value.String())
+		if err != nil || addr.Address != value.String() {
+			return "must be a valid e-mail address"
+		}
+	case "username":
+		if !usernamePattern.MatchString(value.String()) {
+			return "may only contain letters, digits, '.', '_' and '-'"
+		}
+	case "password":
+		// bcrypt limits bytes, not characters
+		if len(value.String()) > maxPasswordBytes {
+			return fmt.Sprintf("must be at most %d bytes", maxPasswordBytes)
+		}
+		return rv.passwordPolicy.check(value.String())
+	case "country":
+		if !countryCodes[value.String()] {
+			return "must be an ISO 3166-1 alpha-2 country code"
+		}
+	case "oneof":
+		for _, option := range strings.Split(arg, "|") {
+			if value.String() == option {
+				return ""
+			}
+		}
+		return "must be one of " + strings.ReplaceAll(arg, "|", ", ")
+	default:
+		panic(fmt.Sprintf("validate: unknown rule %q", name))
+	}
+	return ""
+}
+
+// check returns why the password does not satisfy the policy, or "" if it does.
+func (p PasswordPolicy) check(password string) string {
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	var missing []string
+	if p.RequireUpper && !upper {
+		missing = append(missing, "an uppercase letter")
+	}
+	if p.RequireLower && !lower {
+		missing = append(missing, "a lowercase letter")
+	}
+	if p.RequireDigit && !digit {
+		missing = append(missing, "a digit")
+	}
+	if p.RequireSymbol && !symbol {
+		missing = append(missing, "a symbol")
+	}
+	if utf8.RuneCountInString(password) < p.MinLength {
+		return fmt.Sprintf("must be at least %d characters", p.MinLength)
+	}
+	if len(missing) > 0 {
+		return "must contain " + strings.Join(missing, ", ")
+	}
+	return ""
+}
+
+// countryCodes holds the ISO 3166-1 alpha-2 country codes.
+var countryCodes = func() map[string]bool {
+	codes := map[string]bool{}
+	for _, code := range strings.Fields(`
+AD AE AF AG AI AL AM AO AQ AR AS AT AU AW AX AZ BA BB BD BE BF BG BH BI BJ
+BL BM BN BO BQ BR BS BT BV BW BY BZ CA CC CD CF CG CH CI CK CL CM CN CO CR
+CU CV CW CX CY CZ DE DJ DK DM DO DZ EC EE EG EH ER ES ET FI FJ FK FM FO FR
+GA GB GD GE GF GG GH GI GL GM GN GP GQ GR GS GT GU GW GY HK HM HN HR HT HU
+ID IE IL IM IN IO IQ IR IS IT JE JM JO JP KE KG KH KI KM KN KP KR KW KY KZ
+LA LB LC LI LK LR LS LT LU LV LY MA MC MD ME MF MG MH MK ML MM MN MO MP MQ
+MR MS MT MU MV MW MX MY MZ NA NC NE NF NG NI NL NO NP NR NU NZ OM PA PE PF
+PG PH PK PL PM PN PR PS PT PW PY QA RE RO RS RU RW SA SB SC SD SE SG SH SI
+SJ SK SL SM SN SO SR SS ST SV SX SY SZ TC TD TF TG TH TJ TK TL TM TN TO TR
+TT TV TW TZ UA UG UM US UY UZ VA VC VE VG VI VN VU WF WS YE YT ZA ZM ZW
+`) {
+		codes[code] = true
+	}
+	return codes
+}()
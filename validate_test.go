@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidateUpdateAccountBlankFields(t *testing.T) {
+	rv := &requestValidator{passwordPolicy: PasswordPolicy{MinLength: 8, RequireDigit: true}}
+	blank := ""
+	req := &UpdateAccountRequest{FirstName: &blank, LastName: &blank, Email: &blank, Password: &blank, Country: &blank}
+
+	err := rv.Struct(req)
+	var domainErr *DomainError
+	if !errors.As(err, &domainErr) || domainErr.Kind != KindValidation {
+		t.Fatalf("Struct(blank fields) = %v, want a validation error", err)
+	}
+	failed := map[string]bool{}
+	for _, field := range domainErr.Fields {
+		failed[field.Field] = true
+	}
+	for _, name := range []string{"firstName", "lastName", "email", "password", "country"} {
+		if !failed[name] {
+			t.Errorf("blank %s was accepted", name)
+		}
+	}
+}
+
+func TestValidateUpdateAccountOmittedFields(t *testing.T) {
+	rv := &requestValidator{passwordPolicy: PasswordPolicy{MinLength: 8}}
+	if err := rv.Struct(&UpdateAccountRequest{}); err != nil {
+		t.Fatalf("Struct(empty update) = %v, want nil", err)
+	}
+	country := "DE"
+	if err := rv.Struct(&UpdateAccountRequest{Country: &country}); err != nil {
+		t.Fatalf("Struct(country only) = %v, want nil", err)
+	}
+}
+
+func TestValidateAccountRequest(t *testing.T) {
+	rv := &requestValidator{passwordPolicy: PasswordPolicy{MinLength: 8, RequireDigit: true}}
+	tests := []struct {
+		name  string
+		req   AccountRequest
+		field string
+	}{
+		{"valid", AccountRequest{FirstName: "A", LastName: "B", Email: "a@b.co", Username: "alice", Password: "passw0rd1", Country: "US"}, ""},
+		{"bad email", AccountRequest{FirstName: "A", LastName: "B", Email: "a@", Username: "alice", Password: "passw0rd1", Country: "US"}, "email"},
+		{"weak password", AccountRequest{FirstName: "A", LastName: "B", Email: "a@b.co", Username: "alice", Password: "password", Country: "US"}, "password"},
+		{"bad country", AccountRequest{FirstName: "A", LastName: "B", Email: "a@b.co", Username: "alice", Password: "passw0rd1", Country: "XX"}, "country"},
+		{"blank name", AccountRequest{FirstName: "  ", LastName: "B", Email: "a@b.co", Username: "alice", Password: "passw0rd1", Country: "US"}, "firstName"},
+		{"72-byte password", AccountRequest{FirstName: "A", LastName: "B", Email: "a@b.co", Username: "alice", Password: strings.Repeat("a", 71) + "1", Country: "US"}, ""},
+		{"password over 72 bytes", AccountRequest{FirstName: "A", LastName: "B", Email: "a@b.co", Username: "alice", Password: strings.Repeat("é", 40) + "1", Country: "US"}, "password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rv.Struct(&tt.req)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("Struct = %v, want nil", err)
+				}
+				return
+			}
+			var domainErr *DomainError
+			if !errors.As(err, &domainErr) || len(domainErr.Fields) != 1 || domainErr.Fields[0].Field != tt.field {
+				t.Fatalf("Struct = %v, want a single failure on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestValidatePostLengths(t *testing.T) {
+	rv := &requestValidator{}
+	long := strings.Repeat("a", 256)
+	tests := []struct {
+		name  string
+		req   interface{}
+		field string
+	}{
+		{"valid post", &PostRequest{Title: "Go", Tags: []string{"go"}, Categories: []string{"lang"}}, ""},
+		{"long title", &PostRequest{Title: long}, "title"},
+		{"long slug", &PostRequest{Title: "Go", Slug: long}, "slug"},
+		{"long tag", &PostRequest{Title: "Go", Tags: []string{"go", long[:101]}}, "tags"},
+		{"long category", &PostRequest{Title: "Go", Categories: []string{long[:101]}}, "categories"},
+		{"bad status", &PostRequest{Title: "Go", Status: "archived"}, "status"},
+		{"long update title", &UpdatePostRequest{Title: &long}, "title"},
+		{"long update tag", &UpdatePostRequest{Tags: &[]string{long[:101]}}, "tags"},
+		{"long category name", &CategoryRequest{Name: long[:101]}, "name"},
+		{"long category slug", &CategoryRequest{Name: "Go", Slug: long[:101]}, "slug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := rv.Struct(tt.req)
+			if tt.field == "" {
+				if err != nil {
+					t.Fatalf("Struct = %v, want nil", err)
+				}
+				return
+			}
+			var domainErr *DomainError
+			if !errors.As(err, &domainErr) || len(domainErr.Fields) != 1 || domainErr.Fields[0].Field != tt.field {
+				t.Fatalf("Struct = %v, want a single failure on %s", err, tt.field)
+			}
+		})
+	}
+}
+
+func TestHashPasswordRejectsLongPasswords(t *testing.T) {
+	_, err := hashPassword(strings.Repeat("é", 40) + "1")
+	var domainErr *DomainError
+	if !errors.As(err, &domainErr) || domainErr.Kind != KindValidation {
+		t.Fatalf("hashPassword = %v, want a validation error", err)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	redis "github.com/redis/go-redis/v9"
+)
+
+// emailTokenClaims is the signed payload of an e-mail verification token.
+type emailTokenClaims struct {
+	AccountID int    `json:"a"`
+	Email     string `json:"e"`
+	Expires   int64  `json:"x"`
+	Nonce     string `json:"n"`
+}
+
+// emailTokenKey derives the HMAC key of verification tokens from the JWT secret,
+// so a verification token can never pass as an access token or the other way round.
+func emailTokenKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("email-verification"))
+	return mac.Sum(nil)
+}
+
+// newEmailToken returns a signed token that verifies the account's current e-mail address until ttl passes.
+func newEmailToken(secret string, account *Account, ttl time.Duration) (string, error) {
+	nonce, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(emailTokenClaims{
+		AccountID: account.ID,
+		Email:     account.Email,
+		Expires:   time.Now().Add(ttl).Unix(),
+		Nonce:     nonce,
+	})
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, emailTokenKey(secret))
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." +
+		base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// parseEmailToken checks the signature and expiry of a verification token and returns its claims.
+func parseEmailToken(secret, token string) (*emailTokenClaims, error) {
+	encodedPayload, encodedSig, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, invalidField("token", "invalid verification token")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return nil, invalidField("token", "invalid verification token")
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, invalidField("token", "invalid verification token")
+	}
+	mac := hmac.New(sha256.New, emailTokenKey(secret))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, invalidField("token", "invalid verification token")
+	}
+	claims := new(emailTokenClaims)
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, invalidField("token", "invalid verification token")
+	}
+	if time.Now().Unix() > claims.Expires {
+		return nil, invalidField("token", "verification token has expired")
+	}
+	return claims, nil
+}
+
+// consumeEmailToken marks the token's nonce as used until the token expires.
+// It fails if the token was used before.
+func consumeEmailToken(ctx context.Context, client *redis.Client, claims *emailTokenClaims) error {
+	ttl := time.Until(time.Unix(claims.Expires, 0))
+	if ttl <= 0 {
+		return invalidField("token", "verification token has expired")
+	}
+	first, err := client.SetNX(ctx, "verify:used:"+claims.Nonce, claims.AccountID, ttl).Result()
+	if err != nil {
+		return err
+	}
+	if !first {
+		return invalidField("token", "verification token has already been used")
+	}
+	return nil
+}
+
+// sendVerificationEmail mails the account a link that verifies its e-mail address.
+// Failures are logged rather than returned, so a mail outage does not fail the request that triggered it.
+func (s *APIServer) sendVerificationEmail(ctx context.Context, account *Account) {
+	token, err := newEmailToken(s.auth.JWTSecret, account, s.auth.EmailVerificationTTL)
+	if err != nil {
+		log.Printf("creating verification token for account %d: %v", account.ID, err)
+		return
+	}
+	link := s.publicURL + "/verify-email?token=" + url.QueryEscape(token)
+	msg := Message{
+		To:      account.Email,
+		Subject: "Verify your e-mail address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease confirm your e-mail address by opening this link:\n\n%s\n\n"+
+			"The link expires in %s.\n", account.FirstName, link, s.auth.EmailVerificationTTL),
+	}
+	if err := s.mailer.Send(ctx, msg); err != nil {
+		log.Printf("sending verification mail to account %d: %v", account.ID, err)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSignUpVerifyAndLogin(t *testing.T) {
+	env := newTestEnv(t)
+
+	rec := env.do("POST", "/account", "", map[string]string{"firstName": "A", "lastName": "B", "email": "not-an-address",
+		"username": "alice", "password": "short", "country": "XX"})
+	expectStatus(t, rec, http.StatusBadRequest)
+	if got := strings.Join(problemFields(t, rec), ","); got != "email,password,country" {
+		t.Fatalf("rejected fields = %s, want email,password,country", got)
+	}
+
+	rec = env.do("POST", "/account", "", map[string]string{"firstName": "A", "lastName": "B", "email": "alice@example.com",
+		"username": "alice", "password": "passw0rd1", "country": "US"})
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = env.do("POST", "/login", "", LoginRequest{UserName: "alice", Password: "passw0rd1"})
+	expectStatus(t, rec, http.StatusForbidden)
+
+	expectStatus(t, env.do("GET", env.mailedLink(), "", nil), http.StatusOK)
+	login := env.login("alice", "passw0rd1")
+
+	rec = env.do("GET", "/me", login.Token, nil)
+	expectStatus(t, rec, http.StatusOK)
+	if me := decodeBody[MeResponse](t, rec); me.Username != "alice" || me.Role != "user" {
+		t.Fatalf("/me = %+v, want alice with role user", me)
+	}
+}